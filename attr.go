@@ -0,0 +1,119 @@
+package opalparser
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// attrSpec lists the attributes understood by a type of tag
+type attrSpec struct {
+	flags  []string                     // the flags of the block
+	named  bool                         // whether any other single flag is the name of something, e.g. a language
+	params map[string]func(string) bool // the keys of key/value attributes, with a check of their value or nil
+}
+
+// tagAttrs maps the types of tags to the attributes they understand, tags missing from it have none
+// every inline tag also understands the class attribute
+var tagAttrs = map[NodeType]attrSpec{
+	NodeHeading:     {params: map[string]func(string) bool{"id": nil}},
+	NodeParagraph:   {flags: []string{"pre"}},
+	NodeList:        {flags: []string{"b", "bullet", "n", "number", "check"}, params: map[string]func(string) bool{"start": isInt}},
+	NodeTable:       {flags: []string{"h", "f"}, params: map[string]func(string) bool{"align": isAlign}},
+	NodeCodeBlock:   {named: true, params: map[string]func(string) bool{"lang": nil}},
+	NodeFigure:      {params: map[string]func(string) bool{"width": cssLength}},
+	NodeFootnoteDef: {named: true},
+	NodeHyperlink:   {flags: []string{"newtab"}},
+	NodeCode:        {params: map[string]func(string) bool{"lang": nil}},
+}
+
+// isInline reports whether a type of node is produced by an inline tag
+func isInline(t NodeType) bool {
+	for _, it := range inlineTagNodeTypes {
+		if it == t {
+			return true
+		}
+	}
+	return false
+}
+
+// isClassList reports whether s is a space separated list of class names
+func isClassList(s string) bool {
+	for _, c := range s {
+		if !unicode.IsLetter(c) && !unicode.IsNumber(c) && c != '-' && c != '_' && c != ' ' {
+			return false
+		}
+	}
+	return strings.TrimSpace(s) != ""
+}
+
+// tagLabel returns the name of the tag of a node as it is written, e.g. .table or `b
+func tagLabel(n *Node) string {
+	if isInline(n.Typ) {
+		return "`" + n.tag
+	}
+	return "." + n.tag
+}
+
+func isInt(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// isAlign reports whether s lists column alignments, one of l, c or r for each column
+func isAlign(s string) bool {
+	return strings.Trim(s, "lcr") == ""
+}
+
+// appendAttr adds the flag in the frame to the current node
+func (p *Parser) appendAttr() {
+	n := p.currentNode()
+	if len(p.frame) == 0 {
+		p.addDiagnostic(SeverityError, errMalformedAttr, " ''", "")
+		return
+	}
+	flag := string(p.frame)
+	if spec := tagAttrs[n.Typ]; n.Typ != NodeInvalidTag && !containsString(spec.flags, flag) && !(spec.named && firstFlag(n) == "") {
+		p.addDiagnostic(SeverityWarning, errUnknownAttr, " '"+flag+"' for "+tagLabel(n), "")
+	}
+	n.Attrs = append(n.Attrs, flag)
+}
+
+// setParam sets a key/value attribute of the current node, the frame holding it as key=value
+func (p *Parser) setParam() {
+	n := p.currentNode()
+	i := strings.IndexRune(string(p.frame), charEquals)
+	key, val := string(p.frame[:i]), string(p.frame[i+1:])
+	if key == "" || val == "" {
+		p.addDiagnostic(SeverityError, errMalformedAttr, " '"+key+"="+val+"'", "")
+		return
+	}
+	if _, ok := n.Params[key]; ok {
+		p.addDiagnostic(SeverityWarning, errDuplicateAttr, " '"+key+"'", "")
+		return
+	}
+	if n.Typ != NodeInvalidTag {
+		check, ok := tagAttrs[n.Typ].params[key]
+		if !ok && key == "class" && isInline(n.Typ) {
+			check, ok = isClassList, true
+		}
+		if !ok {
+			p.addDiagnostic(SeverityWarning, errUnknownAttr, " '"+key+"' for "+tagLabel(n), "")
+		} else if check != nil && !check(val) {
+			p.addDiagnostic(SeverityWarning, errAttrValue, " '"+val+"' for "+key, "")
+		}
+	}
+	if n.Params == nil {
+		n.Params = map[string]string{}
+	}
+	n.Params[key] = val
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
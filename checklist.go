@@ -0,0 +1,72 @@
+package opalparser
+
+import "strings"
+
+// taskBoxes lists the checkboxes that can begin the text of a list item, and whether they are checked
+var taskBoxes = []struct {
+	box     string
+	checked bool
+}{
+	{"[ ]", false},
+	{"[x]", true},
+	{"[X]", true},
+}
+
+// Checklist summarises the progress of a list containing tasks
+type Checklist struct {
+	List      *Node `json:"-"`         // the list node
+	Completed int   `json:"completed"` // the number of checked tasks
+	Total     int   `json:"total"`     // the number of tasks
+}
+
+// Checklists returns the progress of every list containing tasks, in the order the lists appear
+// the items of nested lists are counted by their own list only
+func (d *Document) Checklists() []Checklist {
+	var checklists []Checklist
+	walkNodes(d.Root, func(n *Node) {
+		if n.Typ != NodeList {
+			return
+		}
+		c := Checklist{List: n}
+		for _, item := range n.Children {
+			if item.Task {
+				c.Total++
+				if item.Checked {
+					c.Completed++
+				}
+			}
+		}
+		if c.Total > 0 {
+			checklists = append(checklists, c)
+		}
+	})
+	return checklists
+}
+
+// markTasks marks the items of a list and its nested lists as tasks
+// items beginning with a checkbox are tasks, the checkbox being removed from their text,
+// and every item is a task when the list or a list it is nested within has the check attribute
+func markTasks(list *Node, check bool) {
+	check = check || list.hasAttr("check")
+	for _, item := range list.Children {
+		item.Task = check
+		if len(item.Children) > 0 && item.Children[0].Typ == NodeText {
+			text := item.Children[0]
+			for _, t := range taskBoxes {
+				if text.Value == t.box || strings.HasPrefix(text.Value, t.box+" ") {
+					item.Task, item.Checked = true, t.checked
+					text.Value = strings.TrimPrefix(text.Value[len(t.box):], " ")
+					if text.Value == "" {
+						item.Children = item.Children[1:]
+					}
+					break
+				}
+			}
+		}
+		for _, child := range item.Children {
+			if child.Typ == NodeList {
+				markTasks(child, check)
+			}
+		}
+	}
+}
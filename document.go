@@ -0,0 +1,90 @@
+package opalparser
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// Document is a parsed Opal document
+type Document struct {
+	Root        *Node         // the root node of the abstract syntax tree
+	Diagnostics []*Diagnostic // the problems encountered while parsing, in the order they appear
+	File        string        // the path of the parsed file, empty if not parsed from a file
+	Meta        *Meta         // the metadata given by the .meta blocks, nil if there are none
+}
+
+// Errors returns the diagnostics with error severity
+func (d *Document) Errors() ParseErrors {
+	var errs ParseErrors
+	for _, diag := range d.Diagnostics {
+		if diag.Severity == SeverityError {
+			errs = append(errs, diag)
+		}
+	}
+	return errs
+}
+
+// Err returns the syntax errors of the document as ParseErrors, or nil if there are none
+func (d *Document) Err() error {
+	if errs := d.Errors(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// parserPool holds the parsers used by the package level parse functions
+var parserPool = sync.Pool{
+	New: func() interface{} {
+		return New()
+	},
+}
+
+// withParser calls fn with a pooled parser, returning the parser to the pool afterwards
+func withParser(fn func(p *Parser) (*Document, error)) (*Document, error) {
+	p := parserPool.Get().(*Parser)
+	defer func() {
+		p.Reset()
+		parserPool.Put(p)
+	}()
+	return fn(p)
+}
+
+// Parse is used to parse a raw string input of Opal markup into a Document
+// syntax errors are returned as ParseErrors alongside the document
+// it is safe to call from multiple goroutines
+func Parse(input string) (*Document, error) {
+	return withParser(func(p *Parser) (*Document, error) {
+		doc := p.parse(strings.NewReader(input), "")
+		return doc, doc.Err()
+	})
+}
+
+// ParseReader is used to parse Opal markup read from r into a Document
+// the input is decoded incrementally so it never has to be held in memory as a whole,
+// a failure to read from r is returned as is, syntax errors are returned as ParseErrors
+// alongside the document
+// it is safe to call from multiple goroutines
+func ParseReader(r io.Reader) (*Document, error) {
+	return withParser(func(p *Parser) (*Document, error) {
+		doc, err := p.parseReader(r, "")
+		if err != nil {
+			return nil, err
+		}
+		return doc, doc.Err()
+	})
+}
+
+// ParseFile is used to parse a file containing Opal markup into a Document
+// a failure to read the file is returned as is, syntax errors are returned
+// as ParseErrors alongside the document
+// it is safe to call from multiple goroutines
+func ParseFile(filein string) (*Document, error) {
+	return withParser(func(p *Parser) (*Document, error) {
+		doc, err := p.parseFile(filein)
+		if err != nil {
+			return nil, err
+		}
+		return doc, doc.Err()
+	})
+}
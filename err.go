@@ -1,6 +1,10 @@
 package opalparser
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 type errType string
 
@@ -12,32 +16,252 @@ const (
 	errInvalidTagName    = "Invalid tag name"
 	errNoURL             = "No URL provided in link tag"
 	errNoTag             = "No tag name provided"
+	errDuplicateID       = "Duplicate heading ID"
+	errDanglingRef       = "Reference to undefined heading"
+	errNoEnd             = "No .end line closing the block"
+	errCellCount         = "Inconsistent number of cells in table row"
+	errNoSource          = "No source provided for image"
+	errUnexpectedEnd     = "No open block for .end to close"
+	errUndefinedFootnote = "Reference to undefined footnote"
+	errDuplicateFootnote = "Duplicate footnote name"
+	errUnusedFootnote    = "Footnote defined but never referenced"
+	errMetaLine          = "Metadata line is not a key: value pair"
+	errMetaDate          = "Metadata date is not written as YYYY-MM-DD"
+	errMalformedAttr     = "Malformed attribute"
+	errUnterminatedQuote = "Unterminated quoted attribute value"
+	errUnknownAttr       = "Unknown attribute"
+	errAttrValue         = "Invalid attribute value"
+	errDuplicateAttr     = "Duplicate attribute"
+)
+
+// errCodes maps each error to its stable diagnostic code
+// codes must never be reassigned, new errors get the next free code
+var errCodes = map[errType]string{
+	errInvalidTagName:    "OPAL001",
+	errUnexpectedChar:    "OPAL002",
+	errUnexpectedTerm:    "OPAL003",
+	errUnexpectedEOF:     "OPAL004",
+	errNoURL:             "OPAL005",
+	errNoTag:             "OPAL006",
+	errInvalidEscapeChar: "OPAL007",
+	errDuplicateID:       "OPAL008",
+	errDanglingRef:       "OPAL009",
+	errNoEnd:             "OPAL010",
+	errCellCount:         "OPAL011",
+	errNoSource:          "OPAL012",
+	errUnexpectedEnd:     "OPAL013",
+	errUndefinedFootnote: "OPAL014",
+	errDuplicateFootnote: "OPAL015",
+	errUnusedFootnote:    "OPAL016",
+	errMetaLine:          "OPAL017",
+	errMetaDate:          "OPAL018",
+	errMalformedAttr:     "OPAL019",
+	errUnterminatedQuote: "OPAL020",
+	errUnknownAttr:       "OPAL021",
+	errAttrValue:         "OPAL022",
+	errDuplicateAttr:     "OPAL023",
+}
+
+// Severity is the severity of a Diagnostic
+type Severity int
+
+// list of diagnostic severities
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityInfo
 )
 
-// addError appends an error to the Errors property on the root node
+var severityNames = [...]string{
+	SeverityError:   "error",
+	SeverityWarning: "warning",
+	SeverityInfo:    "info",
+}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *Severity) UnmarshalText(b []byte) error {
+	for i, name := range severityNames {
+		if name == string(b) {
+			*s = Severity(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("opalparser: unknown severity %q", b)
+}
+
+// Position is a location within the Opal markup
+type Position struct {
+	Ln     int `json:"line"`   // the line number, starting at 1
+	Col    int `json:"column"` // the column number, starting at 1
+	Offset int `json:"offset"` // the byte offset from the start of the input
+}
+
+// Diagnostic is a problem encountered while parsing Opal markup
+type Diagnostic struct {
+	Code     string   `json:"code"`              // the stable code identifying the kind of problem, e.g. OPAL001
+	Severity Severity `json:"severity"`          // the severity of the problem
+	Msg      string   `json:"message"`           // the description of the problem
+	File     string   `json:"file,omitempty"`    // the file path to the markup file, empty if not parsed from a file
+	Start    Position `json:"start"`             // the start of the offending span
+	End      Position `json:"end"`               // the end of the offending span
+	TagName  string   `json:"tagName,omitempty"` // the name of the offending tag, if any
+	Fix      string   `json:"fix,omitempty"`     // the suggested replacement text for the span, if any
+}
+
+func (d *Diagnostic) Error() string {
+	if d.File == "" {
+		return fmt.Sprintf("%s at line %d, column %d", d.Msg, d.Start.Ln, d.Start.Col)
+	}
+	return fmt.Sprintf("%s at %s:%d:%d", d.Msg, d.File, d.Start.Ln, d.Start.Col)
+}
+
+// ParseErrors is the list of error diagnostics returned by Parse and ParseFile
+// use errors.As to retrieve it from the returned error
+type ParseErrors []*Diagnostic
+
+func (e ParseErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "no errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// addError adds an error diagnostic spanning the current frame
 func (p *Parser) addError(e errType) {
-	var err string
-	if p.filepath == "" {
-		err = fmt.Sprintf("%s at line %d, column %d", e, p.startLn, p.startCol)
-	} else {
-		err = fmt.Sprintf("%s at %s:%d:%d", e, p.filepath, p.startLn, p.startCol)
+	p.addDiagnostic(SeverityError, e, "", "")
+}
+
+// addDiagnostic adds a diagnostic spanning from the start of the current frame to the current character
+func (p *Parser) addDiagnostic(s Severity, e errType, detail, fix string) {
+	d := &Diagnostic{
+		Code:     errCodes[e],
+		Severity: s,
+		Msg:      string(e) + detail,
+		File:     p.filepath,
+		Start:    Position{Ln: p.startLn, Col: p.startCol, Offset: p.startOffset},
+		End:      Position{Ln: p.ln, Col: p.col, Offset: p.offset},
+		TagName:  p.currentNode().tag,
+		Fix:      fix,
 	}
-	p.nodeStack[0].Errors = append(p.nodeStack[0].Errors, errType(err))
+	p.appendDiagnostic(d)
 }
 
-// addErrorUnexpected adds an error for an unexpected character
-func (p *Parser) addErrorUnexpected() {
+// addNodeDiagnostic appends a diagnostic located at the start of a node,
+// for problems found after the node has been parsed
+func (p *Parser) addNodeDiagnostic(n *Node, s Severity, e errType, detail string) {
+	pos := Position{Ln: n.Ln, Col: n.Col, Offset: n.offset}
+	d := &Diagnostic{
+		Code:     errCodes[e],
+		Severity: s,
+		Msg:      string(e) + detail,
+		File:     p.filepath,
+		Start:    pos,
+		End:      pos,
+		TagName:  n.tag,
+	}
+	p.appendDiagnostic(d)
+}
+
+// appendDiagnostic appends a diagnostic to the Diagnostics property on the root node
+// errors are also appended to the Errors property on the root node
+func (p *Parser) appendDiagnostic(d *Diagnostic) {
+	root := p.nodeStack[0]
+	root.Diagnostics = append(root.Diagnostics, d)
+	if d.Severity == SeverityError {
+		root.Errors = append(root.Errors, errType(d.Error()))
+	}
+}
+
+// reportUnexpected adds an error for an unexpected character, without advancing over it
+func (p *Parser) reportUnexpected() {
 	switch p.char {
 	case eof:
 		p.flattenFrame()
 		p.addError(errUnexpectedEOF)
 	case terminator:
 		p.addError(errUnexpectedTerm)
-		p.nextFlat()
 	default:
 		p.flattenFrame()
-		p.addError(errType(errUnexpectedChar+" '"+string(p.char)) + "'")
+		p.addDiagnostic(SeverityError, errUnexpectedChar, " '"+string(p.char)+"'", "")
+	}
+}
+
+// addErrorUnexpected adds an error for an unexpected character
+func (p *Parser) addErrorUnexpected() {
+	p.reportUnexpected()
+	if p.char != eof {
 		p.nextFlat()
 	}
 	p.popNode()
 }
+
+// suggestTagName returns the known tag name closest to the given name,
+// or an empty string if none are similar enough
+func suggestTagName(name string, tagNodeTypes map[string]NodeType) string {
+	names := make([]string, 0, len(tagNodeTypes))
+	for k := range tagNodeTypes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	// allow one edit for every two characters, up to two edits
+	maxDist := len([]rune(name)) / 2
+	if maxDist > 2 {
+		maxDist = 2
+	}
+	best, bestDist := "", maxDist+1
+	for _, k := range names {
+		if d := editDistance(strings.ToLower(name), k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cur := row[j]
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			row[j] = min3(row[j]+1, row[j-1]+1, prev+cost)
+			prev = cur
+		}
+	}
+	return row[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -30,22 +30,37 @@ repeat:
 // parseBlockTag parses BlockTag elements
 // can contain: BlockTagName, BlockTagText
 func parseBlockTag(p *Parser) parseFn {
-	p.createNode(nodeBlockTag)
+	p.createNode(NodeBlockTag)
 
 	p.next() // skip over fullstop
 	p.flattenFrame()
 
 	p.skipWhitespace()
 
+	// the lines of verbatim blocks are read as written, so keep the whitespace ending the tag line unread
+	p.holdLine = isVerbatim(blockTagNodeTypes[strings.ToLower(p.peekKeyword())])
+
 	// get block tag name
 	p.nextOverKeyword()
+	if string(p.frame) == "end" {
+		parseEnd(p)
+		return parseBegin
+	}
 	p.determineNodeType()
+	if isVerbatim(p.nodeType) && p.atLineEnd() {
+		parseVerbatimBlock(p)
+		p.addToParent()
+		return parseBegin
+	}
+	if p.char != charSlash && !unicode.IsSpace(p.char) {
+		p.holdLine = false
+	}
 	switch p.char {
 	case eof:
 		p.addErrorUnexpected()
 		return nil
 	case terminator:
-		p.addToParent()
+		endBlockTag(p)
 		return parseBegin
 	}
 	if len(p.frame) == 0 {
@@ -62,17 +77,19 @@ func parseBlockTag(p *Parser) parseFn {
 	if unicode.IsSpace(p.char) && p.char != charNewline {
 		p.nextFlat()
 	}
+	if p.char != charSlash {
+		p.holdLine = false
+	}
 
 	switch p.char {
 	case eof:
-		p.addToParent()
+		endBlockTag(p)
 		return nil
 	case terminator:
-		p.addToParent()
+		endBlockTag(p)
 		return parseBegin
 	case charColon:
-		p.nextFlat() // skip over colon
-		parseText(p, "\n", nil)
+		parseLineBlock(p)
 		p.addToParent()
 		return parseBegin
 	case charSlash:
@@ -80,7 +97,7 @@ func parseBlockTag(p *Parser) parseFn {
 	case charNewline:
 		p.nextFlat()
 		parseStdBlock(p)
-		p.addToParent()
+		endBlockTag(p)
 		return parseBegin
 	}
 	p.addErrorUnexpected()
@@ -91,104 +108,337 @@ func parseBlockTag(p *Parser) parseFn {
 // can contain: BlockTagAttr
 func parseBlockTagAttrs(p *Parser) parseFn {
 repeat:
-	p.nextFlat()
-	p.nextOverKeyword()
-	p.appendAttr()
+	parseAttr(p)
+	if isVerbatim(p.nodeType) && p.atLineEnd() {
+		parseVerbatimBlock(p)
+		p.addToParent()
+		return parseBegin
+	}
+	if p.char != charSlash {
+		p.holdLine = false
+	}
+	if p.nodeType == NodeParagraph && p.currentNode().hasAttr("pre") && p.atLineEnd() {
+		parsePreformatted(p)
+		p.addToParent()
+		return parseBegin
+	}
 	switch p.char {
 	case eof:
-		p.addToParent()
+		endBlockTag(p)
 		return nil
 	case terminator:
-		p.addToParent()
+		endBlockTag(p)
 		p.nextFlat()
 		return parseBegin
 	case charSlash:
 		goto repeat
+	case charColon:
+		parseLineBlock(p)
+		p.addToParent()
+		return parseBegin
 	case charNewline:
 		p.nextFlat()
 		parseStdBlock(p)
-		p.addToParent()
+		endBlockTag(p)
 		return parseBegin
 	}
 	p.addErrorUnexpected()
 	return parseBegin
 }
 
+// parseAttr parses an attribute following a slash, either a flag or a key/value attribute,
+// and adds it to the current node
+func parseAttr(p *Parser) {
+	p.nextFlat()
+	p.nextOverKeyword()
+	if p.char != charEquals {
+		p.appendAttr()
+		return
+	}
+	p.next()
+	if p.nextOverAttrValue() {
+		p.setParam()
+	}
+}
+
+// parseLineBlock parses the content of a block following a colon on the line of the block tag
+func parseLineBlock(p *Parser) {
+	p.nextFlat() // skip over colon
+	switch {
+	case p.nodeType == NodeFigure:
+		parseFigure(p)
+	case p.nodeType == NodeMathBlock:
+		p.nextOverMath("\n")
+		p.currentNode().Value = strings.TrimSpace(string(p.frame))
+		p.flattenFrame()
+	case isContainer(p.nodeType):
+		p.createNode(NodeParagraph)
+		parseText(p, "\n", nil)
+		p.addToParent()
+	default:
+		parseText(p, "\n", nil)
+	}
+}
+
+// endBlockTag adds the current block to its parent, unless it is a container block,
+// whose body is parsed as any other block elements until its .end line
+func endBlockTag(p *Parser) {
+	if !isContainer(p.currentNode().Typ) {
+		p.addToParent()
+	}
+}
+
+// parseEnd closes the innermost open container block at a `.end` line
+func parseEnd(p *Parser) {
+	p.popNode() // the block tag of the .end line
+	if isContainer(p.currentNode().Typ) {
+		p.addToParent()
+	} else {
+		p.addError(errUnexpectedEnd)
+	}
+	p.flattenFrame()
+}
+
 func parseStdBlock(p *Parser) {
+	if isContainer(p.nodeType) {
+		return
+	}
 	switch p.nodeType {
-	case nodeList:
-		p.createNode(nodeListItem)
-		parseText(p, "-", func() {
-			p.addChild(nodeText, true, false)
-			p.addPopulatedToParent()
-			p.createNode(nodeListItem)
-		})
-		p.addPopulatedToParent()
-	case nodeTable:
-		p.createNode(nodeTableRow)
-		p.createNode(nodeTableData)
-		parseText(p, "|\n", func() {
-			p.addChild(nodeText, true, false)
-			// table data
-			p.addPopulatedToParent()
-			// table row
-			if p.char == charNewline {
+	case NodeList:
+		parseList(p)
+	case NodeFigure:
+		parseFigure(p)
+	case NodeTable:
+		p.createNode(NodeTableRow)
+		p.createNode(NodeTableData)
+		parseText(p, "|\n", func(sep rune) {
+			// table data, empty cells are kept unless they end a row
+			if sep == charNewline {
+				p.addPopulatedToParent()
+				// table row
+				p.addToParent()
+				p.createNode(NodeTableRow)
+			} else {
 				p.addToParent()
-				p.createNode(nodeTableRow)
 			}
 			// new table data
-			p.createNode(nodeTableData)
+			p.createNode(NodeTableData)
 		})
 		// tableData
 		p.addPopulatedToParent()
 		// tableRow
 		p.addPopulatedToParent()
+		p.resolveTableSpans(p.currentNode())
 	default:
 		parseText(p, "", nil)
 	}
 }
 
+// parseList parses the items of a list, each beginning with a marker at the start of a line
+// an item with a longer marker than the previous item begins a list nested within it
+// can contain: ListItem, List
+func parseList(p *Parser) {
+	depth := 1
+	item := func(marker rune, d int) {
+		// a list can only be nested one level deeper than the previous item
+		if d > depth+1 {
+			d = depth + 1
+		}
+		for depth > d {
+			p.addPopulatedToParent() // list item
+			p.addPopulatedToParent() // nested list
+			depth--
+		}
+		if top := p.currentNode(); d > depth {
+			if top.Typ != NodeListItem {
+				p.createNode(NodeListItem)
+			}
+			p.createNode(NodeList)
+			if marker == charHash {
+				p.currentNode().Attrs = []string{"n"}
+			}
+			depth++
+		} else if top.Typ == NodeListItem {
+			p.addPopulatedToParent()
+		} else if marker == charHash && len(top.Attrs) == 0 && len(top.Children) == 0 {
+			// without attributes, the marker of the first item decides the type of the list
+			top.Attrs = []string{"n"}
+		}
+		p.createNode(NodeListItem)
+	}
+
+	if marker, d := parseListMarker(p); d > 0 {
+		item(marker, d)
+		p.nextFlat()
+	} else {
+		p.createNode(NodeListItem)
+	}
+	parseText(p, "\n", func(rune) {
+		if p.char == charHyphen || p.char == charHash {
+			item(parseListMarker(p))
+			p.nextFlat()
+		}
+	})
+	p.addPopulatedToParent()
+	for ; depth > 1; depth-- {
+		p.addPopulatedToParent() // nested list
+		p.addPopulatedToParent() // list item
+	}
+	markTasks(p.currentNode(), false)
+}
+
+// parseListMarker advances the parser over a list item marker, a run of `-` for bullets or `#` for
+// numbered items, stopping on its last character
+// it returns the marker character and the length of the run, which is 0 if there is no marker
+func parseListMarker(p *Parser) (rune, int) {
+	marker := p.char
+	if marker != charHyphen && marker != charHash {
+		return 0, 0
+	}
+	d := 1
+	for p.peek() == marker {
+		p.next()
+		d++
+	}
+	return marker, d
+}
+
+// parseFigure parses the source of an image followed by an optional caption, separated by `|`
+// can contain: Text, InlineTag
+func parseFigure(p *Parser) {
+	p.nextUntil("|\n")
+	figure := p.currentNode()
+	figure.URL = p.frameValue()
+	if figure.URL == "" {
+		p.addError(errNoSource)
+	}
+	p.flattenFrame()
+	if p.char == '|' {
+		p.nextFlat()
+		parseText(p, "\n", nil)
+	}
+}
+
+// isContainer reports whether a block contains other block elements, up to a line containing only `.end`
+func isContainer(t NodeType) bool {
+	switch t {
+	case NodeQuote, NodeNote, NodeWarning, NodeTip:
+		return true
+	}
+	return false
+}
+
+// isVerbatim reports whether the content of a block is kept verbatim rather than parsed
+func isVerbatim(t NodeType) bool {
+	return t == NodeCodeBlock || t == NodeMeta || t == NodeMathBlock
+}
+
+// parseVerbatimBlock parses the content of a block verbatim, up to a line containing only `.end`
+// a line of `.end` preceded by backslashes is kept with one backslash fewer, so `\.end` is kept as `.end`
+// the parser must be at the newline ending the line containing the block tag, with the following lines unread
+func parseVerbatimBlock(p *Parser) {
+	p.holdLine = false
+	var content []rune
+	lineStart := 0
+	for {
+		c := p.nextRaw()
+		if c == eof || c == charNewline {
+			line := strings.TrimSpace(string(content[lineStart:]))
+			if line == ".end" {
+				content = content[:lineStart]
+				break
+			}
+			// a backslash before .end keeps the line as content, dropping the backslash
+			if strings.HasPrefix(line, "\\") && strings.TrimLeft(line, "\\") == ".end" {
+				i := lineStart
+				for content[i] != charBackslash {
+					i++
+				}
+				content = append(content[:i], content[i+1:]...)
+			}
+			if c == eof {
+				p.addNodeDiagnostic(p.currentNode(), SeverityError, errNoEnd, "")
+				break
+			}
+			lineStart = len(content) + 1
+		}
+		content = append(content, c)
+	}
+
+	// drop the newline ending the last line of the content
+	value := strings.TrimSuffix(string(content), "\n")
+	p.currentNode().Value = strings.TrimSuffix(value, "\r")
+	p.spaceRun = p.spaceRun[:0]
+	p.flattenFrame()
+}
+
+// parsePreformatted parses the content of a paragraph keeping its whitespace as it appears in the input
+// the parser must be at the end of the line containing the block tag
+func parsePreformatted(p *Parser) {
+	if p.char == terminator {
+		return
+	}
+	indent := p.spaceAfterNewline()
+	p.preserve = true
+	p.nextFlat()
+	p.frame = append(p.frame, indent...)
+	parseText(p, "", nil)
+	p.preserve = false
+}
+
 // parseParagraph parses paragraphs
 // can contain: Text, InlineTag
 func parseParagraph(p *Parser) parseFn {
-	p.createNode(nodeParagraph)
+	p.createNode(NodeParagraph)
 	parseText(p, "", nil)
 	p.addToParent()
 	return parseBegin
 }
 
 // parseText parses text content
+// the text is split at each character of splitOn, calling callback with the separator once the parser
+// has advanced past it, so nodes it creates begin at the following character
 // can contain: Text, InlineTag
-func parseText(p *Parser, splitOn string, callback func()) {
+func parseText(p *Parser, splitOn string, callback func(sep rune)) {
 repeat:
-	p.nextUntil("`" + string(splitOn))
-	switch p.char {
-	case eof, terminator:
-		if callback != nil {
-			callback()
-		} else {
-			p.addChild(nodeText, true, true)
-		}
+	p.nextUntil("`\\" + string(splitOn))
+	if p.char == eof || p.char == terminator || p.atBlockEnd() {
+		p.addChild(NodeText, true, true)
 		return
 	}
+	if p.char == charBackslash {
+		// hard line break
+		p.addChild(NodeText, true, true)
+		p.addLeaf(NodeLineBreak)
+		p.ignoreChar = true
+		p.next() // skip over backslash
+		p.ignoreChar = false
+		if p.char == charNewline {
+			p.next() // skip over newline
+		}
+		p.flattenFrame()
+		goto repeat
+	}
 	if strings.ContainsRune(splitOn, p.char) {
+		p.addChild(NodeText, true, true)
+		sep := p.char
+		p.nextFlat()
 		if callback != nil {
-			callback()
-		} else {
-			p.addChild(nodeText, true, true)
+			callback(sep)
 		}
-		p.nextFlat()
 		goto repeat
 	}
-	p.addChild(nodeText, true, true)
 	parseInlineTag(p)
 	goto repeat
 }
 
-// parseInlineTag parses InlineTag elements
+// parseInlineTag parses InlineTag elements, adding the text preceding the grave opening them
 // can contain: InlineTagName, InlineTagText
 func parseInlineTag(p *Parser) {
-	p.createNode(nodeInlineTag)
+	spaceBefore := p.frameEndsInSpace()
+	p.addChild(NodeText, true, true)
+	p.createNode(NodeInlineTag)
+	p.currentNode().SpaceBefore = spaceBefore
 
 	p.nextFlat()       // skip over grave
 	p.skipWhitespace() // skip leading space
@@ -197,6 +447,9 @@ func parseInlineTag(p *Parser) {
 	// get inline tag name
 	p.nextOverKeyword()
 	p.determineNodeType()
+	for p.char == charSlash {
+		parseAttr(p)
+	}
 	switch p.char {
 	case eof, terminator:
 		p.addErrorUnexpected()
@@ -211,33 +464,91 @@ func parseInlineTag(p *Parser) {
 	p.nextFlat()
 
 	// get tag text
-	p.nextUntil("`")
-	switch p.char {
-	case eof, terminator:
-		p.addErrorUnexpected()
-		return
+	n := p.currentNode()
+	if n.Typ == NodeMath {
+		p.nextOverMath("`")
+	} else if isRawInline(n.Typ) {
+		p.nextUntil("`")
+	} else {
+		parseInlineBody(p, n)
 	}
 
-	// check for empty tag text
-	if len(p.frame) == 0 {
+	if len(n.Children) > 0 {
+		if n.Typ == NodeHyperlink {
+			parseNestedHyperlink(p, n)
+		}
+	} else if len(p.frame) == 0 {
+		// empty tag text
 		p.addErrorUnexpected()
 		return
+	} else {
+		val := string(p.frame)
+		switch n.Typ {
+		case NodeHyperlink:
+			parseHyperlink(p, val)
+		case NodeImage:
+			parseImage(p, val)
+		default:
+			n.Value = val
+		}
 	}
 
-	val := string(p.frame)
-
-	switch p.nodeType {
-	case nodeHyperlink:
-		parseHyperlink(p, val)
-	default:
-		p.currentNode().Value = val
+	if p.char != charGrave {
+		// a tag left open keeps its text, ending where its text ends
+		p.reportUnexpected()
+		p.flattenFrame()
+		p.addToParent()
+		return
 	}
-
 	p.addToParent()
 	p.next()
+	n.SpaceAfter = unicode.IsSpace(p.char)
 	p.flattenFrame()
 }
 
+// isRawInline reports whether the text of an inline tag is kept as written rather than
+// parsed for nested inline tags
+func isRawInline(t NodeType) bool {
+	switch t {
+	case NodeCode, NodeRef, NodeImage, NodeFootnote, NodeMath, NodeInvalidTag:
+		return true
+	}
+	return false
+}
+
+// parseInlineBody parses the text of an inline tag up to its closing grave, which may contain nested inline tags
+// text without nested tags is left in the frame, otherwise the text and nested tags are added as children
+// a tag left open ends where its text ends, at the end of the paragraph
+func parseInlineBody(p *Parser, n *Node) {
+	for {
+		p.nextUntil("`")
+		if !p.atInlineTag() {
+			break
+		}
+		parseInlineTag(p)
+	}
+	if len(n.Children) > 0 {
+		p.addChild(NodeText, true, true)
+	}
+}
+
+// parseNestedHyperlink takes the URL of a hyperlink containing nested inline tags from the end of its text,
+// the remaining children being its display text
+func parseNestedHyperlink(p *Parser, n *Node) {
+	last := n.Children[len(n.Children)-1]
+	if last.Typ != NodeText {
+		p.addNodeDiagnostic(n, SeverityError, errNoURL, "")
+		return
+	}
+	li := strings.LastIndexAny(last.Value, charsWhitespace)
+	n.URL = last.Value[li+1:]
+	if li == -1 {
+		n.Children = n.Children[:len(n.Children)-1]
+	} else {
+		last.Value = last.Value[:li]
+	}
+}
+
 func parseHyperlink(p *Parser, s string) {
 	li := strings.LastIndexAny(s, charsWhitespace)
 	if li == -1 {
@@ -253,3 +564,13 @@ func parseHyperlink(p *Parser, s string) {
 	p.currentNode().DisplayText = displayText
 	p.currentNode().URL = url
 }
+
+// parseImage parses the alt text and source of an inline image, the source being the last word
+func parseImage(p *Parser, s string) {
+	s = strings.TrimSpace(s)
+	li := strings.LastIndexAny(s, charsWhitespace)
+	p.currentNode().URL = s[li+1:]
+	if li != -1 {
+		p.currentNode().DisplayText = strings.TrimSpace(s[:li])
+	}
+}
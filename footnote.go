@@ -0,0 +1,129 @@
+package opalparser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Footnote is a note referenced from the text of a document
+type Footnote struct {
+	Number  int    `json:"number"` // the number of the footnote, in the order the footnotes are first referenced
+	ID      string `json:"id"`     // the anchor ID of the note
+	RefID   string `json:"refId"`  // the anchor ID of the first reference to the note
+	Text    string `json:"text"`   // the plain text of the note
+	Content *Node  `json:"-"`      // the inline footnote holding the note as its value, or the definition block of a named note
+}
+
+// Footnotes returns the footnotes of the document, in the order they are first referenced
+// references to undefined notes are left out
+func (d *Document) Footnotes() []*Footnote {
+	var notes []*Footnote
+	seen := map[string]bool{}
+	defs := footnoteDefs(d.Root)
+	walkNodes(d.Root, func(n *Node) {
+		if n.Typ != NodeFootnote || n.URL == "" || seen[n.URL] {
+			return
+		}
+		seen[n.URL] = true
+		number, _ := strconv.Atoi(n.DisplayText)
+		note := &Footnote{Number: number, ID: strings.TrimPrefix(n.URL, "#"), RefID: n.ID, Content: n}
+		if def, ok := defs[note.ID]; ok {
+			note.Content = def
+		}
+		note.Text = note.text()
+		notes = append(notes, note)
+	})
+	return notes
+}
+
+// text returns the plain text of a note
+func (f *Footnote) text() string {
+	if f.Content.Typ == NodeFootnote {
+		return f.Content.Value
+	}
+	return f.Content.Text()
+}
+
+// footnoteDefs returns the footnote definition blocks by anchor ID
+func footnoteDefs(root *Node) map[string]*Node {
+	defs := map[string]*Node{}
+	walkNodes(root, func(n *Node) {
+		if n.Typ == NodeFootnoteDef && n.ID != "" {
+			defs[n.ID] = n
+		}
+	})
+	return defs
+}
+
+// footnoteRefName returns the name of the note a footnote refers to, written as #name,
+// or false if the footnote holds the note itself
+func footnoteRefName(n *Node) (string, bool) {
+	if !strings.HasPrefix(n.Value, "#") || strings.ContainsAny(n.Value, charsWhitespace) {
+		return "", false
+	}
+	return n.Value[1:], true
+}
+
+// resolveFootnotes numbers the footnotes in the order they are first referenced and links
+// each reference to its note, named notes are linked to their definition block
+func (p *Parser) resolveFootnotes(root *Node) {
+	var named []*Node // the definitions of named notes, in the order they appear
+	defs := map[string]*Node{}
+	walkNodes(root, func(n *Node) {
+		if n.Typ != NodeFootnoteDef {
+			return
+		}
+		name := firstFlag(n)
+		if _, ok := defs[name]; ok {
+			p.addNodeDiagnostic(n, SeverityWarning, errDuplicateFootnote, " '"+name+"'")
+			return
+		}
+		// notes without a name can never be referenced
+		if name == "" {
+			p.addNodeDiagnostic(n, SeverityWarning, errUnusedFootnote, "")
+			return
+		}
+		n.ID = "fn-" + name
+		defs[name] = n
+		named = append(named, n)
+	})
+
+	numbers := map[*Node]int{} // the number of each note, by the node holding it
+	refs := map[*Node]int{}    // the number of references to each note
+	walkNodes(root, func(n *Node) {
+		if n.Typ != NodeFootnote {
+			return
+		}
+		note, id := n, ""
+		if name, ok := footnoteRefName(n); ok {
+			def, ok := defs[name]
+			if !ok {
+				p.addNodeDiagnostic(n, SeverityWarning, errUndefinedFootnote, " '"+name+"'")
+				n.DisplayText = n.Value
+				return
+			}
+			note, id = def, def.ID
+		}
+		number, ok := numbers[note]
+		if !ok {
+			number = len(numbers) + 1
+			numbers[note] = number
+		}
+		if id == "" {
+			id = "fn-" + strconv.Itoa(number)
+		}
+		refs[note]++
+		n.DisplayText = strconv.Itoa(number)
+		n.URL = "#" + id
+		n.ID = "fnref-" + strconv.Itoa(number)
+		if refs[note] > 1 {
+			n.ID += "-" + strconv.Itoa(refs[note])
+		}
+	})
+
+	for _, def := range named {
+		if refs[def] == 0 {
+			p.addNodeDiagnostic(def, SeverityWarning, errUnusedFootnote, " '"+firstFlag(def)+"'")
+		}
+	}
+}
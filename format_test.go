@@ -0,0 +1,336 @@
+package opalparser
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type HTMLTest struct {
+	rawMarkup string
+	opts      HTMLOptions
+	contains  []string
+	excludes  []string
+}
+
+var htmlTests = []HTMLTest{
+	{"Foo <script>alert(1)</script> & bar", HTMLOptions{}, []string{"Foo &lt;script&gt;alert(1)&lt;/script&gt; &amp; bar"}, []string{"<script>"}},
+	{"Foo `b <i>bar</i>`", HTMLOptions{}, []string{"<b class='opal_Bold'>&lt;i&gt;bar&lt;/i&gt;</b>"}, nil},
+	{"Foo `l bar example.com/?a='b'`", HTMLOptions{}, []string{"href='example.com/?a=&#39;b&#39;'"}, nil},
+	{"Foo `l bar https://example.com`", HTMLOptions{}, []string{"href='https://example.com'"}, nil},
+	{"Foo `l bar javascript:alert(1)`", HTMLOptions{}, []string{"<a class='opal_A'>bar</a>"}, []string{"href"}},
+	{"Foo `l bar JaVa\x01ScRiPt:alert(1)`", HTMLOptions{}, []string{"<a class='opal_A'>bar</a>"}, []string{"href"}},
+	{"Foo `l bar data:text/html,hi`", HTMLOptions{}, []string{"<a class='opal_A'>bar</a>"}, []string{"href"}},
+	{"Foo `l bar data:text/html,hi`", HTMLOptions{AllowedURLSchemes: []string{"data"}}, []string{"href='data:text/html,hi'"}, nil},
+	{".2/id=foo: Bar\n\n`ref foo` `ref baz`", HTMLOptions{}, []string{"<h2 id='foo' class='opal_Heading'>", "<a class='opal_Ref' href='#foo'>Bar</a>", "<span class='opal_Ref'>baz</span>"}, nil},
+	{".code/go\n<b>\n  x := 1\n.end", HTMLOptions{}, []string{"<pre class='opal_CodeBlock'><code class='language-go'>&lt;b&gt;\n  x := 1</code></pre>"}, nil},
+	{".ToC\n\n.1: Foo <bar>\n\n.2: Baz", HTMLOptions{}, []string{"<a class='opal_ToCLink' href='#foo-bar'>Foo &lt;bar&gt;</a>", "<a class='opal_ToCLink' href='#baz'>Baz</a>", "<h1 id='foo-bar' class='opal_Heading'>"}, nil},
+	{".list\n- foo\n## bar", HTMLOptions{}, []string{"<span class='opal_Text'>foo</span>\n\t\t<ol class='opal_ListN'>\n\t\t\t<li class='opal_ListItem'>\n\t\t\t\t<span class='opal_Text'>bar</span>"}, nil},
+	{"Foo `l/newtab bar example.com` `c/lang=sql baz` `b/class=\"qux quux\" corge` `i/class=a<b grault`", HTMLOptions{}, []string{"<a class='opal_A' href='example.com' target='_blank' rel='noopener noreferrer'>bar</a>", "<pre class='opal_Code language-sql'>baz</pre>", "<b class='opal_Bold qux quux'>corge</b>", "<i class='opal_Italic'>grault</i>"}, nil},
+	{"Foo `b bar `l baz `i <qux>` quux.com`` corge", HTMLOptions{}, []string{"<b class='opal_Bold'><span class='opal_Text'>bar</span> <a class='opal_A' href='quux.com'><span class='opal_Text'>baz</span> <i class='opal_Italic'>&lt;qux&gt;</i></a></b> <span class='opal_Text'>corge</span>"}, nil},
+	{"E = mc`sup 2` H`sub 2`O `s foo` `mark bar` `kbd Ctrl`", HTMLOptions{}, []string{"<span class='opal_Text'>E = mc</span><sup class='opal_Sup'>2</sup> <span class='opal_Text'>H</span><sub class='opal_Sub'>2</sub><span class='opal_Text'>O</span> <del class='opal_Strike'>foo</del> <mark class='opal_Mark'>bar</mark> <kbd class='opal_Kbd'>Ctrl</kbd>"}, nil},
+	{"x `sup 2` and y`fn z`\n\n.fn/z: Zed", HTMLOptions{}, []string{"<span class='opal_Text'>x</span> <sup class='opal_Sup'>2</sup> <span class='opal_Text'>and y</span><sup class='opal_FootnoteRef' id='fnref-1'>"}, nil},
+	{"Foo `m a < b^2`\n\n.math\n\\frac{1}{2}\n.end", HTMLOptions{}, []string{"<span class='opal_Math math inline'>\\(a &lt; b^2\\)</span>", "<div class='opal_MathBlock math display'>\\[\\frac{1}{2}\\]</div>"}, nil},
+	{".list/n/start=3\n- foo", HTMLOptions{}, []string{"<ol class='opal_ListN' start='3'>"}, nil},
+	{".list\n- [x] foo\n- [ ] bar", HTMLOptions{}, []string{"<li class='opal_ListItem opal_Task'>\n\t\t<input type='checkbox' class='opal_Checkbox' disabled checked>\n\t\t<span class='opal_Text'>foo</span>", "<input type='checkbox' class='opal_Checkbox' disabled>\n\t\t<span class='opal_Text'>bar</span>"}, nil},
+	{".table/h/f/align=lr\nfoo | bar\nbaz | <\nqux | quux", HTMLOptions{}, []string{"<thead class='opal_TableHead'>\n\t\t<tr class='opal_TableRow'>\n\t\t\t<th class='opal_TableData' style='text-align: left'>", "<tbody class='opal_TableBody'>\n\t\t<tr class='opal_TableRow'>\n\t\t\t<td class='opal_TableData' colspan='2' style='text-align: left'>", "<tfoot class='opal_TableFoot'>", "<td class='opal_TableData' style='text-align: right'>\n\t\t\t\t<span class='opal_Text'>quux</span>"}, nil},
+	{".image/width=50%: foo.png | Foo <bar>\n\n.image/width=url(x): javascript:baz\n\nQux `img quux 'corge'.png`", HTMLOptions{}, []string{"<figure class='opal_Figure' style='width: 50%'>\n\t<img class='opal_Image' src='foo.png' alt='Foo &lt;bar&gt;'>\n\t<figcaption class='opal_Caption'>\n\t\t<span class='opal_Text'>Foo &lt;bar&gt;</span>\n\t</figcaption>\n</figure>", "<figure class='opal_Figure'>\n\t<img class='opal_Image' alt=''>\n</figure>", "<img class='opal_Image' src='&#39;corge&#39;.png' alt='quux'>"}, []string{"url("}},
+	{".quote\nFoo\n.end\n\n.warning: Bar", HTMLOptions{}, []string{"<blockquote class='opal_Quote'>\n<p class='opal_P'>\n\t<span class='opal_Text'>Foo</span>\n</p>\n</blockquote>", "<aside class='opal_Admonition opal_Warning'>\n<p class='opal_AdmonitionLabel'>Warning</p>\n<p class='opal_P'>\n\t<span class='opal_Text'>Bar</span>\n</p>\n</aside>"}, nil},
+	{"Foo\\\nbar\n\n.p/pre\n  a  <b>\n\tc", HTMLOptions{}, []string{"<span class='opal_Text'>Foo</span><br class='opal_Br'><span class='opal_Text'>bar</span>", "<pre class='opal_P opal_Pre'><span class='opal_Text'>  a  &lt;b&gt;\n\tc</span></pre>"}, nil},
+	{".meta\ntitle: Foo <bar>\nauthor: Baz\nlang: en\n.end\n\nQux", HTMLOptions{Standalone: true}, []string{"<!DOCTYPE html>\n<html lang='en'>\n<head>\n\t<meta charset='utf-8'>\n\t<title>Foo &lt;bar&gt;</title>\n\t<meta name='author' content='Baz'>\n</head>\n<body>\n<p class='opal_P'>"}, nil},
+	{".meta\nauthor: Baz\n.end", HTMLOptions{}, nil, []string{"<head>", "Baz"}},
+	{"Foo`fn <bar>` baz`fn #qux`\n\n.fn/qux: Quux", HTMLOptions{}, []string{"<span class='opal_Text'>Foo</span><sup class='opal_FootnoteRef' id='fnref-1'><a href='#fn-1'>1</a></sup> <span class='opal_Text'>baz</span>", "<section class='opal_Footnotes'>\n\t<ol class='opal_FootnoteList'>\n\t\t<li id='fn-1' class='opal_Footnote'>\n\t\t\t&lt;bar&gt;\n\t\t\t<a class='opal_FootnoteBack' href='#fnref-1'>↩</a>", "<li id='fn-qux' class='opal_Footnote'>\n\t\t\t<span class='opal_Text'>Quux</span>"}, nil},
+}
+
+func TestHTML(t *testing.T) {
+	for _, test := range htmlTests {
+		doc, _ := Parse(test.rawMarkup)
+		html := doc.HTMLWith(test.opts)
+		for _, s := range test.contains {
+			if !strings.Contains(html, s) {
+				t.Fatalf("Expected HTML for %q to contain %q, got: %s", test.rawMarkup, s, html)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(html, s) {
+				t.Fatalf("Expected HTML for %q not to contain %q, got: %s", test.rawMarkup, s, html)
+			}
+		}
+	}
+}
+
+// pdfContent renders the document as an uncompressed PDF so its text can be inspected
+func pdfContent(t *testing.T, doc *Document) string {
+	var buf bytes.Buffer
+	pdf := doc.pdf(PDFOptions{})
+	pdf.SetCompression(false)
+	if err := pdf.Output(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// renderUnhandled renders the document as HTML and PDF, returning the types of the nodes
+// each renderer has no case for
+func renderUnhandled(doc *Document) (html, pdf []NodeType) {
+	hr := &htmlRenderer{doc: doc}
+	hr.render(doc.Root)
+	pr := newPDFRenderer(doc, PDFOptions{}, nil)
+	pr.blocks(doc.Root)
+	return hr.unhandled, pr.unhandled
+}
+
+func TestInlineTagsRendered(t *testing.T) {
+	for name, typ := range inlineTagNodeTypes {
+		doc, err := Parse("Foo `" + name + " bar baz`")
+		if err != nil {
+			t.Fatalf("Expected %q to parse, got: %v", name, err)
+		}
+		if html := doc.HTML(); !strings.Contains(html, "bar") {
+			t.Errorf("Expected HTML to render %v, got: %s", typ, html)
+		}
+		if pdf := pdfContent(t, doc); !strings.Contains(pdf, "bar") {
+			t.Errorf("Expected PDF to render %v", typ)
+		}
+		if html, pdf := renderUnhandled(doc); len(html) > 0 || len(pdf) > 0 {
+			t.Errorf("Expected every renderer to handle %v, HTML missed %v and PDF missed %v", typ, html, pdf)
+		}
+	}
+}
+
+func TestBlockTagsRendered(t *testing.T) {
+	for name, typ := range blockTagNodeTypes {
+		doc, _ := Parse("." + name + ": bar baz")
+		if html, pdf := renderUnhandled(doc); len(html) > 0 || len(pdf) > 0 {
+			t.Errorf("Expected every renderer to handle %v, HTML missed %v and PDF missed %v", typ, html, pdf)
+		}
+	}
+	doc, _ := Parse("Foo")
+	doc.Root.Children = append(doc.Root.Children, &Node{Typ: NodeWhitespace})
+	if html, pdf := renderUnhandled(doc); len(html) != 1 || len(pdf) != 1 {
+		t.Fatalf("Expected an unhandled type to be reported, got: %v and %v", html, pdf)
+	}
+}
+
+func TestPDF(t *testing.T) {
+	doc, _ := Parse(".meta\nauthor: Ann Smith\ntags: foo, bar\n.end\n\n" +
+		".Title: Foo\n\n" +
+		".ToC\n\n" +
+		".1: Bar\n\n" +
+		"Baz `b qux` `l quux example.com` `ref Bar`\n\n" +
+		".list/n\n- corge\n- grault\n-- garply\n-- [x] garply\n\n" +
+		".table/h/f/align=lc\nwaldo | fred\nplugh | <\n^ | <\nthud | xyzzy\n\n" +
+		".code\n  x := 1\n.end\n\n" +
+		".p/pre\n  garply  waldo\n\tfred\n\n" +
+		".tip\nplugh\n.end\n\n" +
+		"babble `fn blab` `b bold `i nested`` `s struck` `mark marked` `kbd Esc` `m mc^2`\n\n" +
+		".math: \\frac{1}{\\alpha}")
+	pdf := pdfContent(t, doc)
+	for _, s := range []string{"(Foo)", "(Bar)", "(qux)", "(quux)", "/URI (example.com)", "(1.)", "(2.)", "(grault)", "(garply)", " l S", "(waldo)", "(plugh)", "(thud)", "(xyzzy)", " re B", "(Contents)", "/Dest", "(  x := 1)", "(  garply  waldo)", "(    fred)", "(Tip)", "(plugh)", "(blab)", "(nested)", "(struck)", "(marked)", "(Esc)", "(mc)", "(a)", "/BaseFont /Symbol", "0.463 rg", "/Author (\xfe\xff\x00A", "/Title (\xfe\xff\x00F", "/Keywords"} {
+		if !strings.Contains(pdf, s) {
+			t.Errorf("Expected PDF to contain %q", s)
+		}
+	}
+
+	doc, _ = Parse("H`sub 2`O x `sup 2`")
+	var spaces []bool
+	for _, s := range newPDFRenderer(doc, PDFOptions{}, nil).spans(doc.Root.Children[0], pdfSpan{size: pdfFontSize}) {
+		spaces = append(spaces, s.space)
+	}
+	if !reflect.DeepEqual(spaces, []bool{false, false, false, true}) {
+		t.Errorf("Expected spans to be separated as in the markup, got: %v", spaces)
+	}
+
+	// measuring each nested box on its own would take 2^depth renderings
+	doc, _ = Parse(strings.Repeat(".quote\nfoo\n\n", 40) + "bar" + strings.Repeat("\n.end", 40))
+	r := newPDFRenderer(doc, PDFOptions{}, nil)
+	r.blocks(doc.Root)
+	if len(r.boxes) != 40 {
+		t.Fatalf("Expected each box to be measured once, got: %d", len(r.boxes))
+	}
+
+	// deeply nested content keeps a width to lay out code on
+	doc, _ = Parse(strings.Repeat(".quote\n", 40) + ".code\nfoo\n.end\n" + strings.Repeat(".end\n", 40))
+	if err := doc.PDF().Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPDFTableFootnotes(t *testing.T) {
+	doc, err := Parse(".table\nfoo | bar`fn #baz`\n\n.fn/baz: qux")
+	if err != nil || len(doc.Diagnostics) != 0 || len(doc.Footnotes()) != 1 || doc.Footnotes()[0].ID != "fn-baz" {
+		t.Fatalf("Expected a row referring to a named footnote, got: %v, %v", err, doc.Diagnostics)
+	}
+	r := newPDFRenderer(doc, PDFOptions{}, nil)
+	// leave room for the row, but not for its footnote
+	_, pageH := r.pdf.GetPageSize()
+	rowH := lineHeight(pdfTableSize) + 2*pdfCellPad
+	r.pdf.SetY(pageH - pdfMargin - rowH - 1)
+	r.table(doc.Root.Children[0])
+	if r.pdf.PageNo() != 2 || r.pdf.GetY() != pdfMargin+rowH || len(r.pageNotes) != 1 {
+		t.Fatalf("Expected the row to move to the next page with its footnote, got page %d at %.1f mm", r.pdf.PageNo(), r.pdf.GetY())
+	}
+}
+
+func TestMathLayout(t *testing.T) {
+	r := newPDFRenderer(&Document{Root: &Node{Typ: NodeRoot}}, PDFOptions{}, nil)
+	b := r.typesetMath("xy^2 + \\frac{1}{\\alpha}", 10, true)
+	var texts []string
+	for _, g := range b.glyphs {
+		texts = append(texts, g.text)
+	}
+	if strings.Join(texts, " ") != "xy 2 + 1 a" {
+		t.Fatalf("Expected the glyphs of the TeX, got: %q", texts)
+	}
+	xy, sup, plus, num, den := b.glyphs[0], b.glyphs[1], b.glyphs[2], b.glyphs[3], b.glyphs[4]
+	if xy.font != mathItalic || plus.font != mathSymbol || den.font != mathSymbol {
+		t.Fatalf("Expected italic variables and Symbol operators and letters, got: %+v", b.glyphs)
+	}
+	if sup.y <= 0 || sup.size >= xy.size || sup.x < xy.x+xy.width {
+		t.Fatalf("Expected a smaller raised superscript, got: %+v", sup)
+	}
+	if num.y <= 0 || den.y >= 0 || num.size != xy.size || len(b.lines) != 1 {
+		t.Fatalf("Expected a full size fraction around a rule, got: %+v", b)
+	}
+}
+
+func TestPDFImages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opalparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.png"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "test.opal")
+	if err := ioutil.WriteFile(file, []byte(".image: foo.png | Bar\n\n.image: baz.png\n\nQux `img quux foo.png` `img corge baz.png`"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := ParseFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdf := pdfContent(t, doc)
+	for _, s := range []string{"/Subtype /Image", "(Bar)", "(Qux)", "(baz.png)", "(corge)"} {
+		if !strings.Contains(pdf, s) {
+			t.Errorf("Expected PDF to contain %q", s)
+		}
+	}
+	if strings.Contains(pdf, "(quux)") {
+		t.Error("Expected the alt text of a loaded image not to be rendered")
+	}
+
+	var resolved []string
+	doc.PDFWith(PDFOptions{ImageResolver: func(src string) (io.ReadCloser, error) {
+		resolved = append(resolved, src)
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}})
+	if !reflect.DeepEqual(resolved, []string{"foo.png", "baz.png"}) {
+		t.Fatalf("Expected each image to be resolved once, got: %v", resolved)
+	}
+
+	doc, _ = Parse(".image: " + filepath.Join(dir, "foo.png"))
+	if pdf := pdfContent(t, doc); strings.Contains(pdf, "/Subtype /Image") {
+		t.Error("Expected no images to be embedded without a file or resolver")
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "qux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	resolve := DirImageResolver(filepath.Join(dir, "qux"))
+	for _, src := range []string{filepath.Join(dir, "foo.png"), "/foo.png", "../foo.png", "quux/../../foo.png", "."} {
+		if rc, err := resolve(src); err == nil {
+			rc.Close()
+			t.Errorf("Expected %q not to be opened", src)
+		}
+	}
+	if rc, err := DirImageResolver(dir)("qux/../foo.png"); err != nil {
+		t.Errorf("Expected an image within the directory to be opened, got: %v", err)
+	} else {
+		rc.Close()
+	}
+	if err := os.Symlink(filepath.Join(dir, "foo.png"), filepath.Join(dir, "qux", "link.png")); err != nil {
+		t.Fatal(err)
+	}
+	if rc, err := resolve("link.png"); err == nil {
+		rc.Close()
+		t.Error("Expected a link leading out of the directory not to be opened")
+	}
+	if rc, err := DirImageResolver(dir)("qux/link.png"); err != nil {
+		t.Errorf("Expected a link within the directory to be opened, got: %v", err)
+	} else {
+		rc.Close()
+	}
+
+	r := newPDFRenderer(doc, PDFOptions{ImageResolver: func(src string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.MultiReader(bytes.NewReader(buf.Bytes()), endlessReader{})), nil
+	}}, nil)
+	if r.image("foo.png") != nil || r.pdf.Err() {
+		t.Error("Expected an image larger than the limit not to be embedded")
+	}
+}
+
+// endlessReader reads zeros forever
+type endlessReader struct{}
+
+func (endlessReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestPDFOutput(t *testing.T) {
+	doc, _ := Parse("Foo bar baz")
+	pdf := doc.PDF()
+
+	b, err := pdf.Bytes()
+	if err != nil || !bytes.HasPrefix(b, []byte("%PDF")) {
+		t.Fatalf("Expected PDF contents, got: %.10q, %v", b, err)
+	}
+	encoded, err := pdf.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(encoded); err != nil || !bytes.Equal(decoded, b) {
+		t.Fatalf("Expected Base64 to encode the contents, got: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := pdf.WriteTo(&buf); err != nil || n != int64(len(b)) || !bytes.Equal(buf.Bytes(), b) {
+		t.Fatalf("Expected WriteTo to write the contents, got: %d, %v", n, err)
+	}
+
+	dir, err := ioutil.TempDir("", "opalparser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := pdf.SaveAs(filepath.Join(dir, "test.pdf")); err != nil {
+		t.Fatalf("Expected SaveAs to succeed, got: %v", err)
+	}
+	if err := pdf.SaveAs(filepath.Join(dir, "missing", "test.pdf")); err == nil {
+		t.Fatal("Expected SaveAs to return an error")
+	}
+
+	// the output methods are usable directly on the result of PDF
+	if err := doc.PDF().SaveAs(filepath.Join(dir, "direct.pdf")); err != nil {
+		t.Fatalf("Expected SaveAs to succeed, got: %v", err)
+	}
+	var _ io.WriterTo = doc.PDF()
+}
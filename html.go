@@ -0,0 +1,478 @@
+package opalparser
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HTMLOptions configures the HTML output
+type HTMLOptions struct {
+	// AllowedURLSchemes lists URL schemes permitted in hyperlinks on top of safeURLSchemes,
+	// e.g. "data", links using any other scheme are rendered without a href
+	AllowedURLSchemes []string
+
+	// Standalone renders a complete HTML page whose head holds the title and metadata
+	// of the document, instead of a fragment to be embedded within a page
+	Standalone bool
+}
+
+// safeURLSchemes are the URL schemes always permitted in hyperlinks
+// URLs without a scheme are relative and always permitted
+var safeURLSchemes = []string{"http", "https", "mailto", "ftp", "tel"}
+
+// textEscaper escapes text for use as element content
+var textEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+)
+
+// attrEscaper escapes text for use within a quoted attribute value
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"'", "&#39;",
+	`"`, "&#34;",
+)
+
+func escapeHTML(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
+}
+
+// htmlRenderer holds the state of a single HTML rendering
+type htmlRenderer struct {
+	doc       *Document
+	opts      HTMLOptions
+	unhandled []NodeType // the types of the nodes without a case, which are not rendered
+}
+
+// HTML renders the document as HTML
+func (d *Document) HTML() string {
+	return d.HTMLWith(HTMLOptions{})
+}
+
+// HTMLWith renders the document as HTML using the given options
+func (d *Document) HTMLWith(o HTMLOptions) string {
+	r := &htmlRenderer{doc: d, opts: o}
+	html := r.render(d.Root)
+	if notes := d.Footnotes(); len(notes) > 0 {
+		html += "\n" + r.footnotes(notes)
+	}
+	if o.Standalone {
+		html = r.page(html)
+	}
+	return html
+}
+
+// page wraps the rendered body of the document in a complete HTML page
+func (r *htmlRenderer) page(body string) string {
+	meta := r.doc.Meta
+	if meta == nil {
+		meta = &Meta{}
+	}
+	html := "<!DOCTYPE html>\n<html"
+	if meta.Language != "" {
+		html += " lang='" + escapeAttr(meta.Language) + "'"
+	}
+	html += ">\n<head>\n"
+	html += "\t<meta charset='utf-8'>\n"
+	html += "\t<title>" + escapeHTML(r.doc.title()) + "</title>\n"
+	type metaTag struct{ name, content string }
+	tags := []metaTag{
+		{"author", meta.Author},
+		{"description", meta.Subject},
+		{"keywords", strings.Join(meta.Tags, ", ")},
+		{"date", meta.Date},
+		{"version", meta.Version},
+	}
+	keys := make([]string, 0, len(meta.Extra))
+	for key := range meta.Extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tags = append(tags, metaTag{key, meta.Extra[key]})
+	}
+	for _, tag := range tags {
+		if tag.content != "" {
+			html += bind("\t<meta name='%s' content='%s'>\n", escapeAttr(tag.name), escapeAttr(tag.content))
+		}
+	}
+	html += "</head>\n<body>\n"
+	if body != "" {
+		html += body + "\n"
+	}
+	return html + "</body>\n</html>"
+}
+
+// render renders the block elements of the root node or a container block
+func (r *htmlRenderer) render(root *Node) string {
+	var html string
+	for _, node := range root.Children {
+		switch node.Typ {
+		case NodeTitle:
+			html += "<div class='opal_Title'>\n"
+			html += "\t" + r.text(node)
+			html += "</div>\n"
+		case NodeToC:
+			if toc := r.doc.ToC(); len(toc) > 0 {
+				html += "<nav class='opal_ToC'>\n"
+				html += r.toc(toc, "\t")
+				html += "</nav>\n"
+			}
+		case NodeHeading:
+			html += "<h" + node.Level + " id='" + escapeAttr(node.ID) + "' class='opal_Heading'>\n"
+			html += "\t" + r.text(node)
+			html += "</h" + node.Level + ">\n"
+		case NodeCodeBlock:
+			html += "<pre class='opal_CodeBlock'><code"
+			if lang := codeLanguage(node); lang != "" {
+				html += " class='language-" + escapeAttr(lang) + "'"
+			}
+			html += ">" + escapeHTML(node.Text()) + "</code></pre>\n"
+		case NodeMathBlock:
+			html += "<div class='opal_MathBlock math display'>\\[" + escapeHTML(node.Text()) + "\\]</div>\n"
+		case NodeFigure:
+			html += "<figure class='opal_Figure'"
+			if width, ok := node.attr("width"); ok && cssLength(width) {
+				html += " style='width: " + width + "'"
+			}
+			html += ">\n"
+			html += bind("\t<img class='opal_Image'%s alt='%s'>\n", r.src(node.URL), escapeAttr(node.Text()))
+			if len(node.Children) > 0 {
+				html += "\t<figcaption class='opal_Caption'>\n"
+				html += "\t\t" + r.text(node)
+				html += "\t</figcaption>\n"
+			}
+			html += "</figure>\n"
+		case NodeQuote:
+			html += "<blockquote class='opal_Quote'>\n"
+			html += r.body(node)
+			html += "</blockquote>\n"
+		case NodeNote, NodeWarning, NodeTip:
+			html += "<aside class='opal_Admonition opal_" + node.Typ.String() + "'>\n"
+			html += "<p class='opal_AdmonitionLabel'>" + node.Typ.String() + "</p>\n"
+			html += r.body(node)
+			html += "</aside>\n"
+		case NodeParagraph:
+			if node.hasAttr("pre") {
+				html += "<pre class='opal_P opal_Pre'>" + r.preText(node) + "</pre>\n"
+				break
+			}
+			html += "<p class='opal_P'>\n"
+			html += "\t" + r.text(node)
+			html += "</p>\n"
+		case NodeTable:
+			html += r.table(node)
+		case NodeList:
+			html += r.list(node, "")
+		case NodeMeta, NodeFootnoteDef:
+			// metadata is rendered in the head of standalone pages and notes in the footnotes section
+		default:
+			r.unhandled = append(r.unhandled, node.Typ)
+		}
+	}
+	if len(html) > 0 {
+		return html[:len(html)-1]
+	}
+	return ""
+}
+
+// body renders the block elements of a container block
+func (r *htmlRenderer) body(n *Node) string {
+	if html := r.render(n); html != "" {
+		return html + "\n"
+	}
+	return ""
+}
+
+func bind(format string, a ...interface{}) string {
+	return fmt.Sprintf(format, a...)
+}
+
+// text renders the inline elements of a node, separated by a space where whitespace separates them in the markup,
+// as recorded by their SpaceBefore and SpaceAfter
+func (r *htmlRenderer) text(n *Node) string {
+	var html string
+	var prev *Node
+	for _, v := range n.Children {
+		s := r.inline(v)
+		if s == "" {
+			continue
+		}
+		if prev != nil && (prev.SpaceAfter || v.SpaceBefore) {
+			html += " "
+		}
+		html += s
+		prev = v
+	}
+	return html + "\n"
+}
+
+// preText renders the inline elements of a node with preserved whitespace, so without separators
+func (r *htmlRenderer) preText(n *Node) string {
+	var html string
+	for _, v := range n.Children {
+		html += r.inline(v)
+	}
+	return html
+}
+
+// inline renders an inline element
+func (r *htmlRenderer) inline(v *Node) string {
+	switch v.Typ {
+	case NodeText:
+		return bind("<span class='opal_Text'>%s</span>", escapeHTML(v.Value))
+	case NodeBoldText:
+		return bind("<b class='%s'>%s</b>", class(v, "opal_Bold"), r.content(v))
+	case NodeCode:
+		base := "opal_Code"
+		if lang, ok := v.attr("lang"); ok {
+			base += " language-" + lang
+		}
+		return bind("<pre class='%s'>%s</pre>", class(v, base), escapeHTML(v.Value))
+	case NodeHyperlink:
+		var target string
+		if v.hasAttr("newtab") {
+			target = " target='_blank' rel='noopener noreferrer'"
+		}
+		return bind("<a class='%s'%s%s>%s</a>", class(v, "opal_A"), r.href(v.URL), target, r.content(v))
+	case NodeItalicText:
+		return bind("<i class='%s'>%s</i>", class(v, "opal_Italic"), r.content(v))
+	case NodeUnderlineText:
+		return bind("<u class='%s'>%s</u>", class(v, "opal_Underline"), r.content(v))
+	case NodeRef:
+		if v.URL == "" {
+			return bind("<span class='%s'>%s</span>", class(v, "opal_Ref"), escapeHTML(v.DisplayText))
+		}
+		return bind("<a class='%s' href='%s'>%s</a>", class(v, "opal_Ref"), escapeAttr(v.URL), escapeHTML(v.DisplayText))
+	case NodeBoldItalic:
+		return bind("<b class='%s'><i class='opal_Italic'>%s</i></b>", class(v, "opal_Bold"), r.content(v))
+	case NodeBoldUnderline:
+		return bind("<b class='%s'><u class='opal_Underline'>%s</u></b>", class(v, "opal_Bold"), r.content(v))
+	case NodeItalicUnderline:
+		return bind("<i class='%s'><u class='opal_Underline'>%s</u></i>", class(v, "opal_Italic"), r.content(v))
+	case NodeStrikethrough:
+		return bind("<del class='%s'>%s</del>", class(v, "opal_Strike"), r.content(v))
+	case NodeSuperscript:
+		return bind("<sup class='%s'>%s</sup>", class(v, "opal_Sup"), r.content(v))
+	case NodeSubscript:
+		return bind("<sub class='%s'>%s</sub>", class(v, "opal_Sub"), r.content(v))
+	case NodeHighlight:
+		return bind("<mark class='%s'>%s</mark>", class(v, "opal_Mark"), r.content(v))
+	case NodeKeyboard:
+		return bind("<kbd class='%s'>%s</kbd>", class(v, "opal_Kbd"), r.content(v))
+	case NodeMath:
+		return bind("<span class='%s'>\\(%s\\)</span>", class(v, "opal_Math math inline"), escapeHTML(v.Value))
+	case NodeImage:
+		return bind("<img class='%s'%s alt='%s'>", class(v, "opal_Image"), r.src(v.URL), escapeAttr(v.DisplayText))
+	case NodeLineBreak:
+		return "<br class='opal_Br'>"
+	case NodeFootnote:
+		if v.URL == "" {
+			return bind("<sup class='%s'>%s</sup>", class(v, "opal_FootnoteRef"), escapeHTML(v.DisplayText))
+		}
+		return bind("<sup class='%s' id='%s'><a href='%s'>%s</a></sup>", class(v, "opal_FootnoteRef"), escapeAttr(v.ID), escapeAttr(v.URL), escapeHTML(v.DisplayText))
+	case NodeList, NodeInvalidTag:
+		// nested lists are rendered by list, and unknown tags are reported by the parser
+		return ""
+	}
+	r.unhandled = append(r.unhandled, v.Typ)
+	return ""
+}
+
+// content renders the content of an inline element, its nested inline elements if it has any
+// and otherwise its text
+func (r *htmlRenderer) content(v *Node) string {
+	if len(v.Children) == 0 {
+		if v.Typ == NodeHyperlink {
+			return escapeHTML(v.DisplayText)
+		}
+		return escapeHTML(v.Value)
+	}
+	return strings.TrimSuffix(r.text(v), "\n")
+}
+
+// class returns the escaped classes of an inline element, its base classes followed by those
+// given by its class attribute
+func class(v *Node, base string) string {
+	if c, ok := v.attr("class"); ok && isClassList(c) {
+		base += " " + strings.Join(strings.Fields(c), " ")
+	}
+	return escapeAttr(base)
+}
+
+// table renders a table, its first row being the header with the h attribute
+// and its last row being the footer with the f attribute
+func (r *htmlRenderer) table(n *Node) string {
+	rows, _ := tableGrid(n)
+	hasHeader, hasFooter := n.hasAttr("h"), n.hasAttr("f")
+	// rows are only grouped into sections if there is a header or footer
+	indent := "\t"
+	if hasHeader || hasFooter {
+		indent = "\t\t"
+	}
+	html := "<table class='opal_Table'>\n"
+	section := ""
+	for i, row := range rows {
+		header := i == 0 && hasHeader
+		footer := i == len(rows)-1 && hasFooter && !header
+		if hasHeader || hasFooter {
+			s, class := "tbody", "opal_TableBody"
+			if header {
+				s, class = "thead", "opal_TableHead"
+			} else if footer {
+				s, class = "tfoot", "opal_TableFoot"
+			}
+			if s != section {
+				if section != "" {
+					html += "\t</" + section + ">\n"
+				}
+				html += "\t<" + s + " class='" + class + "'>\n"
+				section = s
+			}
+		}
+		html += indent + "<tr class='opal_TableRow'>\n"
+		for _, data := range row {
+			t := "td"
+			if header {
+				t = "th"
+			}
+			html += indent + "\t<" + t + " class='opal_TableData'"
+			if data.ColSpan > 1 {
+				html += " colspan='" + strconv.Itoa(data.ColSpan) + "'"
+			}
+			if data.RowSpan > 1 {
+				html += " rowspan='" + strconv.Itoa(data.RowSpan) + "'"
+			}
+			if align := columnAlign(n, data.col); align != "" {
+				html += " style='text-align: " + align + "'"
+			}
+			html += ">\n"
+			html += indent + "\t\t" + r.text(data.Node)
+			html += indent + "\t</" + t + ">\n"
+		}
+		html += indent + "</tr>\n"
+	}
+	if section != "" {
+		html += "\t</" + section + ">\n"
+	}
+	return html + "</table>\n"
+}
+
+// list renders a list and the lists nested within its items
+// tasks are rendered with a disabled checkbox showing whether they are checked
+func (r *htmlRenderer) list(n *Node, indent string) string {
+	listType, class := "ul", "opal_ListB"
+	if listNumbered(n) {
+		listType, class = "ol", "opal_ListN"
+	}
+	html := indent + "<" + listType + " class='" + class + "'"
+	if start := listStart(n); listNumbered(n) && start != 1 {
+		html += " start='" + strconv.Itoa(start) + "'"
+	}
+	html += ">\n"
+	for _, item := range n.Children {
+		if item.Task {
+			var checked string
+			if item.Checked {
+				checked = " checked"
+			}
+			html += indent + "\t<li class='opal_ListItem opal_Task'>\n"
+			html += indent + "\t\t<input type='checkbox' class='opal_Checkbox' disabled" + checked + ">\n"
+		} else {
+			html += indent + "\t<li class='opal_ListItem'>\n"
+		}
+		if text := r.text(item); text != "\n" {
+			html += indent + "\t\t" + text
+		}
+		for _, child := range item.Children {
+			if child.Typ == NodeList {
+				html += r.list(child, indent+"\t\t")
+			}
+		}
+		html += indent + "\t</li>\n"
+	}
+	return html + indent + "</" + listType + ">\n"
+}
+
+// footnotes renders the notes section, linking each note back to its first reference
+func (r *htmlRenderer) footnotes(notes []*Footnote) string {
+	html := "<section class='opal_Footnotes'>\n"
+	html += "\t<ol class='opal_FootnoteList'>\n"
+	for _, note := range notes {
+		html += "\t\t<li id='" + escapeAttr(note.ID) + "' class='opal_Footnote'>\n"
+		if note.Content.Typ == NodeFootnote {
+			html += "\t\t\t" + escapeHTML(note.Content.Value) + "\n"
+		} else {
+			html += "\t\t\t" + r.text(note.Content)
+		}
+		html += "\t\t\t<a class='opal_FootnoteBack' href='#" + escapeAttr(note.RefID) + "'>↩</a>\n"
+		html += "\t\t</li>\n"
+	}
+	return html + "\t</ol>\n</section>"
+}
+
+// toc renders table of contents entries as a nested list of links
+func (r *htmlRenderer) toc(entries []*ToCEntry, indent string) string {
+	html := indent + "<ul class='opal_ToCList'>\n"
+	for _, entry := range entries {
+		html += indent + "\t<li class='opal_ToCItem'>\n"
+		html += bind(indent+"\t\t<a class='opal_ToCLink' href='#%s'>%s</a>\n", escapeAttr(entry.ID), escapeHTML(entry.Text))
+		if len(entry.Children) > 0 {
+			html += r.toc(entry.Children, indent+"\t\t")
+		}
+		html += indent + "\t</li>\n"
+	}
+	return html + indent + "</ul>\n"
+}
+
+// href returns the escaped href attribute for a URL, or nothing if its scheme is not permitted
+func (r *htmlRenderer) href(url string) string {
+	if !r.allowedURL(url) {
+		return ""
+	}
+	return " href='" + escapeAttr(url) + "'"
+}
+
+// src returns the escaped src attribute for the URL of an image, or nothing if its scheme is not permitted
+func (r *htmlRenderer) src(url string) string {
+	if !r.allowedURL(url) {
+		return ""
+	}
+	return " src='" + escapeAttr(url) + "'"
+}
+
+// allowedURL reports whether the scheme of a URL is permitted
+func (r *htmlRenderer) allowedURL(url string) bool {
+	// browsers ignore whitespace and control characters within schemes, e.g. "java\tscript:"
+	s := strings.Map(func(c rune) rune {
+		if c <= ' ' || c == 0x7f {
+			return -1
+		}
+		return c
+	}, url)
+	i := strings.IndexAny(s, ":/?#")
+	if i <= 0 || s[i] != ':' {
+		return true
+	}
+	scheme := s[:i]
+	for _, allowed := range safeURLSchemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	for _, allowed := range r.opts.AllowedURLSchemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
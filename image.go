@@ -0,0 +1,96 @@
+package opalparser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageResolver opens the image with the given source, as written in the markup,
+// so it can be embedded in PDFs
+type ImageResolver func(src string) (io.ReadCloser, error)
+
+// maxImageSize is the largest image in bytes read from an ImageResolver, larger images are not embedded
+const maxImageSize = 32 << 20
+
+// DirImageResolver returns an ImageResolver opening image files relative to dir
+// sources must stay within dir, absolute paths, paths or symbolic links leading out of dir and URLs are not supported,
+// nor are files other than regular files, e.g. devices and named pipes
+func DirImageResolver(dir string) ImageResolver {
+	return func(src string) (io.ReadCloser, error) {
+		if strings.Contains(src, "://") {
+			return nil, fmt.Errorf("opalparser: cannot open image URL %q", src)
+		}
+		rel := filepath.Clean(filepath.FromSlash(src))
+		if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || strings.HasPrefix(rel, string(filepath.Separator)) ||
+			rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("opalparser: image %q is outside of %q", src, dir)
+		}
+		path := filepath.Join(dir, rel)
+		// a symbolic link within dir may lead out of it, so the path is checked again once links are followed
+		if !withinDir(dir, path) {
+			return nil, fmt.Errorf("opalparser: image %q is outside of %q", src, dir)
+		}
+		// opening a named pipe blocks until it is written to, so the file is checked before opening it
+		if info, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("opalparser: image %q is not a regular file", src)
+		}
+		return os.Open(path)
+	}
+}
+
+// withinDir reports whether path is within dir once the symbolic links of both are followed
+func withinDir(dir, path string) bool {
+	if dir == "" {
+		dir = "."
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// a file that does not exist is reported when it is opened
+		return os.IsNotExist(err)
+	}
+	base, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return false
+	}
+	if base, err = filepath.Abs(base); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(base, real)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// imageType returns the type of image data as understood by gofpdf, or an empty string if it is not supported
+func imageType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	}
+	return ""
+}
+
+// cssLength reports whether s is a CSS length or percentage, e.g. 50% or 120px
+func cssLength(s string) bool {
+	num := strings.TrimRight(s, "%abcdefghijklmnopqrstuvwxyz")
+	switch s[len(num):] {
+	case "", "%", "px", "em", "rem", "mm", "cm", "in", "pt", "vw":
+	default:
+		return false
+	}
+	if num == "" || strings.Count(num, ".") > 1 {
+		return false
+	}
+	return strings.Trim(num, "0123456789.") == ""
+}
@@ -0,0 +1,452 @@
+package opalparser
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// list of measurements used to typeset math, in ems of the font size
+const (
+	mathScriptScale = 0.7  // the font size of scripts, and the fractions of inline math, relative to their base
+	mathMinSize     = 5.0  // the smallest font size of math in pt
+	mathAscent      = 0.7  // the height of a glyph above the baseline
+	mathDescent     = 0.2  // the depth of a glyph below the baseline
+	mathSupShift    = 0.4  // the least distance the baseline of a superscript is raised
+	mathSubShift    = 0.25 // the least distance the baseline of a subscript is lowered
+	mathAxis        = 0.25 // the height of the rule of a fraction above the baseline
+	mathFracGap     = 0.15 // the space between the rule of a fraction and its numerator and denominator
+	mathRule        = 0.05 // the thickness of the rules of fractions and roots
+	mathOpSpace     = 0.25 // the space either side of binary operators and relations
+	mathPunctSpace  = 0.17 // the space following punctuation
+)
+
+// mathFont is a font of the glyphs of math, variables being set in italics
+type mathFont struct {
+	family string
+	style  string
+}
+
+// list of fonts used to typeset math
+var (
+	mathItalic = mathFont{"Times", "I"}
+	mathRoman  = mathFont{"Times", ""}
+	mathSymbol = mathFont{"Symbol", ""}
+)
+
+// mathGreek maps the names of Greek letters to their characters in the Symbol font
+var mathGreek = map[string]byte{
+	"alpha": 'a', "beta": 'b', "gamma": 'g', "delta": 'd', "epsilon": 'e', "zeta": 'z', "eta": 'h',
+	"theta": 'q', "vartheta": 'J', "iota": 'i', "kappa": 'k', "lambda": 'l', "mu": 'm', "nu": 'n',
+	"xi": 'x', "omicron": 'o', "pi": 'p', "rho": 'r', "sigma": 's', "tau": 't', "upsilon": 'u',
+	"phi": 'f', "varphi": 'j', "chi": 'c', "psi": 'y', "omega": 'w',
+	"Gamma": 'G', "Delta": 'D', "Theta": 'Q', "Lambda": 'L', "Xi": 'X', "Pi": 'P', "Sigma": 'S',
+	"Upsilon": 'U', "Phi": 'F', "Psi": 'Y', "Omega": 'W',
+}
+
+// mathSymbols maps the names of symbols to their characters in the Symbol font
+var mathSymbols = map[string]byte{
+	"infty": 0xA5, "partial": 0xB6, "nabla": 0xD1, "forall": 0x22, "exists": 0x24, "emptyset": 0xC6,
+	"prime": 0xA2, "ldots": 0xBC, "dots": 0xBC, "sum": 0xE5, "prod": 0xD5, "int": 0xF2,
+}
+
+// mathOps maps the names of binary operators and relations to their characters in the Symbol font
+var mathOps = map[string]byte{
+	"times": 0xB4, "cdot": 0xD7, "pm": 0xB1, "div": 0xB8, "cap": 0xC7, "cup": 0xC8,
+	"leq": 0xA3, "le": 0xA3, "geq": 0xB3, "ge": 0xB3, "neq": 0xB9, "ne": 0xB9, "approx": 0xBB,
+	"equiv": 0xBA, "propto": 0xB5, "in": 0xCE, "to": 0xAE, "rightarrow": 0xAE, "leftarrow": 0xAC,
+	"Rightarrow": 0xDE, "implies": 0xDE, "Leftarrow": 0xDC, "iff": 0xDB,
+}
+
+// mathFunctions lists the names of functions set upright
+var mathFunctions = []string{"sin", "cos", "tan", "cot", "sec", "csc", "log", "ln", "exp", "lim", "max", "min", "det", "sup", "inf"}
+
+// mathSpaces maps the names of spacing commands to their width in ems
+var mathSpaces = map[string]float64{",": 0.17, ":": 0.22, ">": 0.22, ";": 0.28, " ": 0.25, "!": -0.17, "quad": 1, "qquad": 2}
+
+// mathSymbolWidths maps the characters of the Symbol font used by math to their widths in thousandths of an em
+var mathSymbolWidths = map[byte]int{
+	' ': 250, '+': 549, '-': 549, '=': 549, '<': 549, '>': 549, 0x22: 713, 0x24: 549,
+	'a': 631, 'b': 549, 'g': 411, 'd': 494, 'e': 439, 'z': 494, 'h': 603, 'q': 521, 'J': 631, 'i': 329,
+	'k': 549, 'l': 549, 'm': 576, 'n': 521, 'x': 493, 'o': 549, 'p': 549, 'r': 549, 's': 603, 't': 439,
+	'u': 576, 'f': 521, 'j': 603, 'c': 549, 'y': 686, 'w': 686,
+	'G': 603, 'D': 612, 'Q': 741, 'L': 686, 'X': 645, 'P': 768, 'S': 592, 'U': 690, 'F': 763, 'Y': 795, 'W': 768,
+	0xA2: 247, 0xA3: 549, 0xA5: 713, 0xAC: 987, 0xAE: 987, 0xB1: 549, 0xB3: 549, 0xB4: 549, 0xB5: 713,
+	0xB6: 494, 0xB8: 549, 0xB9: 549, 0xBA: 549, 0xBB: 549, 0xBC: 1000, 0xC6: 823, 0xC7: 768, 0xC8: 768,
+	0xCE: 713, 0xD1: 713, 0xD5: 823, 0xD7: 250, 0xDB: 1042, 0xDC: 987, 0xDE: 987, 0xE5: 713, 0xF2: 274,
+}
+
+// mathSymbolFont is the definition of the Symbol core font, which gofpdf otherwise replaces by ZapfDingbats
+var mathSymbolFont = func() string {
+	cw := make([]int, 256)
+	for c, w := range mathSymbolWidths {
+		cw[c] = w
+	}
+	def, _ := json.Marshal(map[string]interface{}{"Tp": "Core", "Name": "Symbol", "Up": -100, "Ut": 50, "Cw": cw})
+	return string(def)
+}()
+
+// mathKind is the kind of a mathAtom
+type mathKind int
+
+// list of kinds of math atoms
+const (
+	mathGlyph mathKind = iota // a run of text in a single font
+	mathGroup                 // a braced list of atoms
+	mathFrac                  // a fraction of two lists of atoms
+	mathSqrt                  // a square root of a list of atoms
+	mathSpace                 // a space of a given width
+)
+
+// mathAtom is an element of TeX, which may carry a superscript and a subscript
+type mathAtom struct {
+	kind  mathKind
+	text  string      // the text of a glyph, in the encoding of its font
+	font  mathFont    // the font of a glyph
+	op    bool        // whether a glyph is a binary operator or relation, spaced either side
+	punct bool        // whether a glyph is punctuation, followed by a space
+	width float64     // the width of a space in ems
+	body  []*mathAtom // the atoms of a group or root, or the numerator of a fraction
+	den   []*mathAtom // the denominator of a fraction
+	sup   []*mathAtom
+	sub   []*mathAtom
+}
+
+// texParser parses the subset of TeX typeset in PDF output
+// commands outside the subset are set as written
+type texParser struct {
+	src []rune
+	pos int
+	tr  func(string) string // translates UTF-8 text to the encoding of the core fonts
+}
+
+// parseTeX parses TeX into math atoms
+func parseTeX(tex string, tr func(string) string) []*mathAtom {
+	p := &texParser{src: []rune(tex), tr: tr}
+	return p.list(0)
+}
+
+// list parses atoms up to the closing character, which is consumed, or the end of the TeX
+func (p *texParser) list(closing rune) []*mathAtom {
+	var atoms []*mathAtom
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == closing:
+			p.pos++
+			return atoms
+		case unicode.IsSpace(c):
+			p.pos++
+		case c == '^' || c == '_':
+			p.pos++
+			if len(atoms) == 0 {
+				atoms = append(atoms, &mathAtom{kind: mathGroup})
+			}
+			last := atoms[len(atoms)-1]
+			if c == '^' {
+				last.sup = p.arg()
+			} else {
+				last.sub = p.arg()
+			}
+		default:
+			if a := p.atom(); a != nil {
+				atoms = append(atoms, a)
+			}
+		}
+	}
+	return atoms
+}
+
+// arg parses the argument of a command or script, a braced list or a single atom
+func (p *texParser) arg() []*mathAtom {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == len(p.src) {
+		return nil
+	}
+	if p.src[p.pos] == '{' {
+		p.pos++
+		return p.list('}')
+	}
+	if a := p.atom(); a != nil {
+		return []*mathAtom{a}
+	}
+	return nil
+}
+
+// atom parses a single atom, returning nil for characters that are not set
+func (p *texParser) atom() *mathAtom {
+	c := p.src[p.pos]
+	p.pos++
+	switch {
+	case c == '{':
+		return &mathAtom{kind: mathGroup, body: p.list('}')}
+	case c == '}':
+		return nil
+	case c == '\\':
+		return p.command()
+	case unicode.IsLetter(c):
+		return &mathAtom{kind: mathGlyph, text: p.tr(string(c)), font: mathItalic}
+	case strings.ContainsRune("+-=<>", c):
+		return &mathAtom{kind: mathGlyph, text: string(c), font: mathSymbol, op: true}
+	case c == '*':
+		return &mathAtom{kind: mathGlyph, text: string(c), font: mathRoman, op: true}
+	case c == ',' || c == ';':
+		return &mathAtom{kind: mathGlyph, text: string(c), font: mathRoman, punct: true}
+	case c == '\'':
+		return &mathAtom{kind: mathGlyph, text: string([]byte{0xA2}), font: mathSymbol}
+	}
+	return &mathAtom{kind: mathGlyph, text: p.tr(string(c)), font: mathRoman}
+}
+
+// command parses a command following its backslash
+func (p *texParser) command() *mathAtom {
+	start := p.pos
+	for p.pos < len(p.src) && unicode.IsLetter(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start && p.pos < len(p.src) {
+		p.pos++
+	}
+	name := string(p.src[start:p.pos])
+	switch name {
+	case "frac":
+		num := p.arg()
+		return &mathAtom{kind: mathFrac, body: num, den: p.arg()}
+	case "sqrt":
+		return &mathAtom{kind: mathSqrt, body: p.arg()}
+	case "text", "textrm", "mathrm", "operatorname":
+		return &mathAtom{kind: mathGlyph, text: p.tr(p.rawArg()), font: mathRoman}
+	case "left", "right":
+		// delimiters are set at the size of the text
+		return nil
+	case "{", "}", "_", "%", "$", "#", "&":
+		return &mathAtom{kind: mathGlyph, text: name, font: mathRoman}
+	}
+	if c, ok := mathGreek[name]; ok {
+		return &mathAtom{kind: mathGlyph, text: string([]byte{c}), font: mathSymbol}
+	}
+	if c, ok := mathSymbols[name]; ok {
+		return &mathAtom{kind: mathGlyph, text: string([]byte{c}), font: mathSymbol}
+	}
+	if c, ok := mathOps[name]; ok {
+		return &mathAtom{kind: mathGlyph, text: string([]byte{c}), font: mathSymbol, op: true}
+	}
+	if w, ok := mathSpaces[name]; ok {
+		return &mathAtom{kind: mathSpace, width: w}
+	}
+	if containsString(mathFunctions, name) {
+		return &mathAtom{kind: mathGlyph, text: name, font: mathRoman, punct: true}
+	}
+	if name == "\\" {
+		// line breaks only break display math, which is split at them beforehand
+		return &mathAtom{kind: mathSpace, width: 1}
+	}
+	return &mathAtom{kind: mathGlyph, text: p.tr("\\" + name), font: mathRoman}
+}
+
+// rawArg returns the text of a braced argument as written
+func (p *texParser) rawArg() string {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == len(p.src) || p.src[p.pos] != '{' {
+		return ""
+	}
+	start, depth := p.pos+1, 0
+	for ; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+		if depth == 0 {
+			p.pos++
+			return string(p.src[start : p.pos-1])
+		}
+	}
+	return string(p.src[start:])
+}
+
+// mathBox is typeset math, its glyphs and lines positioned relative to the start of its baseline
+// distances are in mm, with y increasing upwards
+type mathBox struct {
+	width   float64
+	ascent  float64
+	descent float64
+	glyphs  []mathPlaced
+	lines   []mathLine
+}
+
+// mathPlaced is a glyph placed within a mathBox
+type mathPlaced struct {
+	text  string
+	font  mathFont
+	size  float64
+	x, y  float64
+	width float64
+}
+
+// mathLine is a line drawn within a mathBox, such as the rule of a fraction
+type mathLine struct {
+	x1, y1, x2, y2 float64
+	thickness      float64
+}
+
+// add places another box within the box with its baseline starting at x, y
+// glyphs continuing the text of the previous glyph are merged with it
+func (b *mathBox) add(c mathBox, x, y float64) {
+	for _, g := range c.glyphs {
+		g.x, g.y = g.x+x, g.y+y
+		if n := len(b.glyphs); n > 0 {
+			last := &b.glyphs[n-1]
+			if last.font == g.font && last.size == g.size && last.y == g.y && math.Abs(last.x+last.width-g.x) < 1e-9 {
+				last.text += g.text
+				last.width += g.width
+				continue
+			}
+		}
+		b.glyphs = append(b.glyphs, g)
+	}
+	for _, l := range c.lines {
+		b.lines = append(b.lines, mathLine{l.x1 + x, l.y1 + y, l.x2 + x, l.y2 + y, l.thickness})
+	}
+	b.ascent = math.Max(b.ascent, c.ascent+y)
+	b.descent = math.Max(b.descent, c.descent-y)
+}
+
+// mathFontSize returns the font size of math scaled down from size, no smaller than mathMinSize
+func mathFontSize(size float64) float64 {
+	return math.Max(size*mathScriptScale, mathMinSize)
+}
+
+// typesetMath typesets TeX at the given font size, display math setting fractions at full size
+func (r *pdfRenderer) typesetMath(tex string, size float64, display bool) mathBox {
+	return r.mathList(parseTeX(tex, r.tr), size, display, false)
+}
+
+// mathList typesets a list of atoms side by side
+// operators are only spaced outside of scripts, and not when they start the list or follow another operator
+func (r *pdfRenderer) mathList(atoms []*mathAtom, size float64, display, script bool) mathBox {
+	const mmPerPt = 25.4 / 72
+	em := size * mmPerPt
+	var b mathBox
+	for i, a := range atoms {
+		var after float64
+		if a.op && !script && i > 0 && !atoms[i-1].op {
+			b.width += mathOpSpace * em
+			after = mathOpSpace * em
+		} else if a.punct && !script {
+			after = mathPunctSpace * em
+		}
+		c := r.mathAtom(a, size, display, script)
+		b.add(c, b.width, 0)
+		b.width += c.width + after
+	}
+	return b
+}
+
+// mathAtom typesets an atom followed by its scripts
+func (r *pdfRenderer) mathAtom(a *mathAtom, size float64, display, script bool) mathBox {
+	const mmPerPt = 25.4 / 72
+	em := size * mmPerPt
+	var b mathBox
+	switch a.kind {
+	case mathGlyph:
+		r.setMathFont(a.font, size)
+		w := r.pdf.GetStringWidth(a.text)
+		b = mathBox{width: w, ascent: mathAscent * em, descent: mathDescent * em}
+		b.glyphs = []mathPlaced{{text: a.text, font: a.font, size: size, width: w}}
+	case mathGroup:
+		b = r.mathList(a.body, size, display, script)
+	case mathSpace:
+		b.width = a.width * em
+	case mathFrac:
+		inner := size
+		if !display {
+			inner = mathFontSize(size)
+		}
+		num := r.mathList(a.body, inner, false, script)
+		den := r.mathList(a.den, inner, false, script)
+		pad := mathFracGap * em
+		b.width = math.Max(num.width, den.width) + 2*pad
+		axis, gap, rule := mathAxis*em, mathFracGap*em, mathRule*em
+		b.add(num, (b.width-num.width)/2, axis+rule/2+gap+num.descent)
+		b.add(den, (b.width-den.width)/2, axis-rule/2-gap-den.ascent)
+		b.lines = append(b.lines, mathLine{pad / 2, axis, b.width - pad/2, axis, rule})
+	case mathSqrt:
+		body := r.mathList(a.body, size, display, script)
+		gap, rule := mathFracGap*em, mathRule*em
+		top := math.Max(body.ascent, mathAscent*em) + gap
+		bottom := math.Max(body.descent, mathDescent*em)
+		sign := 0.5 * em
+		b.add(body, sign+gap/2, 0)
+		b.width = sign + body.width + gap
+		b.lines = append(b.lines,
+			mathLine{0, top * 0.4, sign * 0.25, top * 0.5, rule},
+			mathLine{sign * 0.25, top * 0.5, sign * 0.55, -bottom, rule * 1.5},
+			mathLine{sign * 0.55, -bottom, sign, top, rule},
+			mathLine{sign, top, b.width, top, rule})
+		b.ascent = top + rule
+	}
+	if a.sup == nil && a.sub == nil {
+		return b
+	}
+	scriptSize := mathFontSize(size)
+	x := b.width
+	if a.sup != nil {
+		sup := r.mathList(a.sup, scriptSize, false, true)
+		b.add(sup, x, math.Max(mathSupShift*em, b.ascent-sup.ascent*0.5))
+		b.width = math.Max(b.width, x+sup.width)
+	}
+	if a.sub != nil {
+		sub := r.mathList(a.sub, scriptSize, false, true)
+		b.add(sub, x, -math.Max(mathSubShift*em, b.descent-sub.ascent*0.5))
+		b.width = math.Max(b.width, x+sub.width)
+	}
+	return b
+}
+
+// setMathFont applies a font of math, registering the Symbol font when first used
+func (r *pdfRenderer) setMathFont(f mathFont, size float64) {
+	if f == mathSymbol {
+		r.pdf.AddFontFromReader(f.family, f.style, strings.NewReader(mathSymbolFont))
+	}
+	r.pdf.SetFont(f.family, f.style, size)
+}
+
+// drawMath draws typeset math with its baseline starting at x, y
+func (r *pdfRenderer) drawMath(b mathBox, x, y float64, color [3]int) {
+	r.pdf.SetTextColor(color[0], color[1], color[2])
+	for _, g := range b.glyphs {
+		r.setMathFont(g.font, g.size)
+		r.pdf.Text(x+g.x, y-g.y, g.text)
+	}
+	r.pdf.SetDrawColor(color[0], color[1], color[2])
+	for _, l := range b.lines {
+		r.pdf.SetLineWidth(l.thickness)
+		r.pdf.Line(x+l.x1, y-l.y1, x+l.x2, y-l.y2)
+	}
+	r.pdf.SetDrawColor(0, 0, 0)
+	r.pdf.SetLineWidth(0.2)
+}
+
+// mathBlock renders display math centred, each line of TeX separated by \\ set on a line of its own
+func (r *pdfRenderer) mathBlock(n *Node) {
+	for _, line := range strings.Split(n.Text(), `\\`) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		b := r.typesetMath(line, pdfMathSize, true)
+		lh := math.Max(lineHeight(pdfMathSize), b.ascent+b.descent+2*pdfCellPad)
+		r.ensureSpace(lh)
+		y := r.pdf.GetY()
+		// centre the ink of the line vertically within it
+		baseline := y + (lh-b.ascent-b.descent)/2 + b.ascent
+		r.drawMath(b, r.x+(r.width-b.width)/2, baseline, [3]int{})
+		r.pdf.SetXY(r.x, y+lh)
+	}
+}
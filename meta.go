@@ -0,0 +1,98 @@
+package opalparser
+
+import (
+	"strings"
+	"time"
+)
+
+// metaDateLayout is the layout of dates in metadata, e.g. 2006-01-02
+const metaDateLayout = "2006-01-02"
+
+// Meta is the metadata of a document, given as key: value lines within a .meta block
+// keys are case insensitive, keys other than those below are kept in Extra
+type Meta struct {
+	Title    string            `json:"title,omitempty"`    // the title of the document, defaulting to the text of the .Title block
+	Author   string            `json:"author,omitempty"`   // the author of the document
+	Subject  string            `json:"subject,omitempty"`  // a description of the document, also written as description
+	Date     string            `json:"date,omitempty"`     // the date of the document, written as YYYY-MM-DD
+	Version  string            `json:"version,omitempty"`  // the version of the document
+	Tags     []string          `json:"tags,omitempty"`     // the comma separated keywords of the document, also written as keywords
+	Language string            `json:"language,omitempty"` // the language of the document, e.g. en, also written as lang
+	Extra    map[string]string `json:"extra,omitempty"`    // the values of any other keys, by lowercase key
+}
+
+// Time returns the date of the document, or false if it has none
+func (m *Meta) Time() (time.Time, bool) {
+	t, err := time.Parse(metaDateLayout, m.Date)
+	return t, err == nil
+}
+
+// title returns the title of a document given its metadata, which may be nil
+func (d *Document) title() string {
+	if d.Meta != nil && d.Meta.Title != "" {
+		return d.Meta.Title
+	}
+	var title string
+	walkNodes(d.Root, func(n *Node) {
+		if n.Typ == NodeTitle && title == "" {
+			title = n.Text()
+		}
+	})
+	return title
+}
+
+// parseMeta collects the metadata of the .meta blocks of a document, or returns nil if it has none
+// later blocks override the keys of earlier ones
+func (p *Parser) parseMeta(root *Node) *Meta {
+	var meta *Meta
+	walkNodes(root, func(n *Node) {
+		if n.Typ != NodeMeta {
+			return
+		}
+		if meta == nil {
+			meta = &Meta{}
+		}
+		for _, line := range strings.Split(n.Text(), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			i := strings.IndexByte(line, ':')
+			if i <= 0 {
+				p.addNodeDiagnostic(n, SeverityWarning, errMetaLine, " '"+line+"'")
+				continue
+			}
+			key, val := strings.ToLower(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:])
+			switch key {
+			case "title":
+				meta.Title = val
+			case "author":
+				meta.Author = val
+			case "subject", "description":
+				meta.Subject = val
+			case "date":
+				if _, err := time.Parse(metaDateLayout, val); err != nil {
+					p.addNodeDiagnostic(n, SeverityWarning, errMetaDate, " '"+val+"'")
+				}
+				meta.Date = val
+			case "version":
+				meta.Version = val
+			case "tags", "keywords":
+				meta.Tags = nil
+				for _, tag := range strings.Split(val, ",") {
+					if tag = strings.TrimSpace(tag); tag != "" {
+						meta.Tags = append(meta.Tags, tag)
+					}
+				}
+			case "language", "lang":
+				meta.Language = val
+			default:
+				if meta.Extra == nil {
+					meta.Extra = map[string]string{}
+				}
+				meta.Extra[key] = val
+			}
+		}
+	})
+	return meta
+}
@@ -1,72 +1,270 @@
 package opalparser
 
-import "strings"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
 
 // Node is a grammatically defined element in the Opal language
 // these are used to construct the abstract syntax tree
 type Node struct {
-	Typ         nodeType  `json:"type,omitempty"`
-	Errors      []errType `json:"errors,omitempty"`
-	Value       string    `json:"value,omitempty"`
-	Attrs       []string  `json:"attrs,omitempty"`
-	DisplayText string    `json:"displayText,omitempty"`
-	URL         string    `json:"url,omitempty"`
-	Level       string    `json:"level,omitempty"`
-	Ln          int       `json:"line,omitempty"`
-	Col         int       `json:"column,omitempty"`
-	Children    []*Node   `json:"children,omitempty"`
+	Typ         NodeType          `json:"type,omitempty"`
+	Errors      []errType         `json:"-"` // the messages of the error diagnostics on the root node, serialised as Diagnostics
+	Value       string            `json:"value,omitempty"`
+	Attrs       []string          `json:"attrs,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+	DisplayText string            `json:"displayText,omitempty"`
+	URL         string            `json:"url,omitempty"`
+	Level       string            `json:"level,omitempty"`
+	ID          string            `json:"id,omitempty"`
+	Task        bool              `json:"task,omitempty"`
+	Checked     bool              `json:"checked,omitempty"`
+	ColSpan     int               `json:"colSpan,omitempty"`
+	RowSpan     int               `json:"rowSpan,omitempty"`
+	SpaceBefore bool              `json:"spaceBefore,omitempty"` // whether whitespace precedes the inline element in the markup
+	SpaceAfter  bool              `json:"spaceAfter,omitempty"`  // whether whitespace follows the inline element in the markup
+	Ln          int               `json:"line,omitempty"`
+	Col         int               `json:"column,omitempty"`
+	Children    []*Node           `json:"children,omitempty"`
+
+	// Diagnostics and Meta are only populated on the root node
+	Diagnostics []*Diagnostic `json:"diagnostics,omitempty"`
+	Meta        *Meta         `json:"meta,omitempty"`
+
+	tag    string // the tag name as written in the markup, for tag nodes
+	offset int    // the starting byte offset of the node
 }
 
-type nodeType int
+// NodeType identifies the kind of element a Node represents
+type NodeType int
 
 // list of nodes that can be parsed
 const (
-	nodeEOF nodeType = iota
-	nodeInvalidTag
-	nodeWhitespace
-	nodeRoot
-	nodeText
-	nodeListItem
-	nodeTagName
-	nodeBlockTag
-	nodeBlockTagLine
-	nodeAttr
-	nodeParagraph
-	nodeList
-	nodeTable
-	nodeTitle
-	nodeToC
-	nodeHeading
-	nodeInlineTag
-	nodeHyperlink
-	nodeBoldText
-	nodeItalicText
-	nodeUnderlineText
-	nodeBoldItalic
-	nodeBoldUnderline
-	nodeItalicUnderline
-	nodeCode
-	nodeTableRow
-	nodeTableData
+	NodeEOF NodeType = iota
+	NodeInvalidTag
+	NodeWhitespace
+	NodeRoot
+	NodeText
+	NodeListItem
+	NodeTagName
+	NodeBlockTag
+	NodeBlockTagLine
+	NodeAttr
+	NodeParagraph
+	NodeList
+	NodeTable
+	NodeTitle
+	NodeToC
+	NodeHeading
+	NodeInlineTag
+	NodeHyperlink
+	NodeBoldText
+	NodeItalicText
+	NodeUnderlineText
+	NodeBoldItalic
+	NodeBoldUnderline
+	NodeItalicUnderline
+	NodeCode
+	NodeTableRow
+	NodeTableData
+	NodeRef
+	NodeCodeBlock
+	NodeLineBreak
+	NodeFigure
+	NodeImage
+	NodeQuote
+	NodeNote
+	NodeWarning
+	NodeTip
+	NodeFootnote
+	NodeFootnoteDef
+	NodeMeta
+	NodeStrikethrough
+	NodeSuperscript
+	NodeSubscript
+	NodeHighlight
+	NodeKeyboard
+	NodeMath
+	NodeMathBlock
 )
 
+var nodeTypeNames = [...]string{
+	NodeEOF:             "EOF",
+	NodeInvalidTag:      "InvalidTag",
+	NodeWhitespace:      "Whitespace",
+	NodeRoot:            "Root",
+	NodeText:            "Text",
+	NodeListItem:        "ListItem",
+	NodeTagName:         "TagName",
+	NodeBlockTag:        "BlockTag",
+	NodeBlockTagLine:    "BlockTagLine",
+	NodeAttr:            "Attr",
+	NodeParagraph:       "Paragraph",
+	NodeList:            "List",
+	NodeTable:           "Table",
+	NodeTitle:           "Title",
+	NodeToC:             "ToC",
+	NodeHeading:         "Heading",
+	NodeInlineTag:       "InlineTag",
+	NodeHyperlink:       "Hyperlink",
+	NodeBoldText:        "BoldText",
+	NodeItalicText:      "ItalicText",
+	NodeUnderlineText:   "UnderlineText",
+	NodeBoldItalic:      "BoldItalic",
+	NodeBoldUnderline:   "BoldUnderline",
+	NodeItalicUnderline: "ItalicUnderline",
+	NodeCode:            "Code",
+	NodeTableRow:        "TableRow",
+	NodeTableData:       "TableData",
+	NodeRef:             "Ref",
+	NodeCodeBlock:       "CodeBlock",
+	NodeLineBreak:       "LineBreak",
+	NodeFigure:          "Figure",
+	NodeImage:           "Image",
+	NodeQuote:           "Quote",
+	NodeNote:            "Note",
+	NodeWarning:         "Warning",
+	NodeTip:             "Tip",
+	NodeFootnote:        "Footnote",
+	NodeFootnoteDef:     "FootnoteDef",
+	NodeMeta:            "Meta",
+	NodeStrikethrough:   "Strikethrough",
+	NodeSuperscript:     "Superscript",
+	NodeSubscript:       "Subscript",
+	NodeHighlight:       "Highlight",
+	NodeKeyboard:        "Keyboard",
+	NodeMath:            "Math",
+	NodeMathBlock:       "MathBlock",
+}
+
+func (t NodeType) String() string {
+	if t < 0 || int(t) >= len(nodeTypeNames) {
+		return fmt.Sprintf("NodeType(%d)", int(t))
+	}
+	return nodeTypeNames[t]
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (t NodeType) MarshalText() ([]byte, error) {
+	if t < 0 || int(t) >= len(nodeTypeNames) {
+		return nil, fmt.Errorf("opalparser: unknown node type %d", int(t))
+	}
+	return []byte(nodeTypeNames[t]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+// names are matched case insensitively
+func (t *NodeType) UnmarshalText(b []byte) error {
+	for i, name := range nodeTypeNames {
+		if strings.EqualFold(name, string(b)) {
+			*t = NodeType(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("opalparser: unknown node type %q", b)
+}
+
+// Text returns the plain text content of the node and its descendants
+func (n *Node) Text() string {
+	var b strings.Builder
+	n.writeText(&b)
+	return b.String()
+}
+
+func (n *Node) writeText(b *strings.Builder) {
+	s := n.Value
+	if n.DisplayText != "" {
+		s = n.DisplayText
+	}
+	if s != "" {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(s)
+	}
+	for _, child := range n.Children {
+		// footnotes are not part of the running text
+		if child.Typ != NodeFootnote {
+			child.writeText(b)
+		}
+	}
+}
+
+// hasAttr reports whether the node has any of the given flags
+func (n *Node) hasAttr(names ...string) bool {
+	for _, attr := range n.Attrs {
+		for _, name := range names {
+			if attr == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attr returns the value of a key/value attribute, written as key=value
+func (n *Node) attr(key string) (string, bool) {
+	val, ok := n.Params[key]
+	return val, ok
+}
+
+// codeLanguage returns the language of a code block, given by its lang attribute or as its first flag
+func codeLanguage(n *Node) string {
+	if lang, ok := n.attr("lang"); ok {
+		return lang
+	}
+	return firstFlag(n)
+}
+
+// firstFlag returns the first flag of a node
+func firstFlag(n *Node) string {
+	if len(n.Attrs) == 0 {
+		return ""
+	}
+	return n.Attrs[0]
+}
+
+// listNumbered reports whether a list is numbered rather than bulleted,
+// based on its first attribute
+func listNumbered(n *Node) bool {
+	if len(n.Attrs) == 0 {
+		return false
+	}
+	switch n.Attrs[0] {
+	case "n", "number":
+		return true
+	}
+	return false
+}
+
+// listStart returns the number of the first item of a numbered list, given by its start attribute
+func listStart(n *Node) int {
+	if start, err := strconv.Atoi(n.Params["start"]); err == nil {
+		return start
+	}
+	return 1
+}
+
 // makeNode returns a new node
 // parent nodes have only a type and list of children
-func (p *Parser) makeNode(n nodeType, hasVal, hasLineInfo bool) *Node {
+func (p *Parser) makeNode(n NodeType, hasVal, hasLineInfo bool) *Node {
 	val := ""
-	var startLn, startCol int
+	var startLn, startCol, startOffset int
 	if hasVal {
-		val = trim(string(p.frame))
+		val = p.frameValue()
 	}
 	if hasLineInfo {
 		startLn = p.startLn
 		startCol = p.startCol
+		startOffset = p.startOffset
 	}
-	return &Node{Typ: n, Value: val, Ln: startLn, Col: startCol}
+	return &Node{Typ: n, Value: val, Ln: startLn, Col: startCol, offset: startOffset}
 }
 
 // createNode appends a new parent node to the node stack
-func (p *Parser) createNode(n nodeType) {
+func (p *Parser) createNode(n NodeType) {
 	p.nodeStack = append(p.nodeStack, p.makeNode(n, false, true))
 	p.nodeType = n
 	p.nodesParsedLinear = append(p.nodesParsedLinear, n)
@@ -91,23 +289,36 @@ func (p *Parser) lastNode() *Node {
 }
 
 // addChild appends a new child node to the topmost node from the node stack
-func (p *Parser) addChild(n nodeType, merge, hasLineInfo bool) {
+func (p *Parser) addChild(n NodeType, merge, hasLineInfo bool) {
 	// if the last node is of the same type, add the frame content
 	// to the end of the last node
-	val := trim(string(p.frame))
+	val := p.frameValue()
 	if val != "" {
 		lastNode := p.lastNode()
-		if merge && lastNode != nil && lastNode.Typ == n && n != nodeListItem {
-			p.lastNode().Value += " " + val
+		if merge && lastNode != nil && lastNode.Typ == n && n != NodeListItem {
+			if !p.preserve {
+				val = " " + val
+			}
+			lastNode.Value += val
 		} else {
+			lastNode = p.makeNode(n, true, hasLineInfo)
+			lastNode.SpaceBefore = unicode.IsSpace(p.frame[0])
 			topNode := p.currentNode()
-			topNode.Children = append(topNode.Children, p.makeNode(n, true, hasLineInfo))
+			topNode.Children = append(topNode.Children, lastNode)
 		}
+		lastNode.SpaceAfter = p.frameEndsInSpace()
 	}
 	p.flattenFrame()
 	p.nodesParsedLinear = append(p.nodesParsedLinear, n)
 }
 
+// addLeaf appends a new node without a value or children to the topmost node from the node stack
+func (p *Parser) addLeaf(n NodeType) {
+	topNode := p.currentNode()
+	topNode.Children = append(topNode.Children, p.makeNode(n, false, true))
+	p.nodesParsedLinear = append(p.nodesParsedLinear, n)
+}
+
 // popNode removes the topmost node from the node stack
 func (p *Parser) popNode() {
 	p.nodeStack = p.nodeStack[:len(p.nodeStack)-1]
@@ -141,49 +352,73 @@ func (p *Parser) addPopulatedToParent() {
 	}
 }
 
+// blockTagNodeTypes maps block tag names to the type of node they produce
+var blockTagNodeTypes = map[string]NodeType{
+	"1":       NodeHeading,
+	"2":       NodeHeading,
+	"3":       NodeHeading,
+	"4":       NodeHeading,
+	"5":       NodeHeading,
+	"6":       NodeHeading,
+	"code":    NodeCodeBlock,
+	"fn":      NodeFootnoteDef,
+	"image":   NodeFigure,
+	"list":    NodeList,
+	"math":    NodeMathBlock,
+	"meta":    NodeMeta,
+	"note":    NodeNote,
+	"p":       NodeParagraph,
+	"quote":   NodeQuote,
+	"table":   NodeTable,
+	"tip":     NodeTip,
+	"toc":     NodeToC,
+	"title":   NodeTitle,
+	"warning": NodeWarning,
+}
+
+// maxInlineTagName is the length of the longest inline tag name
+const maxInlineTagName = 4
+
+// inlineTagNodeTypes maps inline tag names to the type of node they produce
+// every type listed here must be handled by every output format
+var inlineTagNodeTypes = map[string]NodeType{
+	"b":    NodeBoldText,
+	"bi":   NodeBoldItalic,
+	"ib":   NodeBoldItalic,
+	"bu":   NodeBoldUnderline,
+	"ub":   NodeBoldUnderline,
+	"c":    NodeCode,
+	"fn":   NodeFootnote,
+	"i":    NodeItalicText,
+	"img":  NodeImage,
+	"iu":   NodeItalicUnderline,
+	"ui":   NodeItalicUnderline,
+	"kbd":  NodeKeyboard,
+	"l":    NodeHyperlink,
+	"m":    NodeMath,
+	"mark": NodeHighlight,
+	"ref":  NodeRef,
+	"s":    NodeStrikethrough,
+	"sub":  NodeSubscript,
+	"sup":  NodeSuperscript,
+	"u":    NodeUnderlineText,
+}
+
 func (p *Parser) determineNodeType() {
 	if len(p.frame) == 0 {
 		return
 	}
-	var t nodeType
-	switch strings.ToLower(string(p.frame)) {
-	case "1", "2", "3", "4", "5", "6":
-		t = nodeHeading
-	case "b":
-		t = nodeBoldText
-	case "bi", "ib":
-		t = nodeBoldItalic
-	case "bu", "ub":
-		t = nodeBoldUnderline
-	case "c":
-		t = nodeCode
-	case "i":
-		t = nodeItalicText
-	case "iu", "ui":
-		t = nodeItalicUnderline
-	case "l":
-		t = nodeHyperlink
-	case "list":
-		t = nodeList
-	case "table":
-		t = nodeTable
-	case "toc":
-		t = nodeToC
-	case "title":
-		t = nodeTitle
-	case "u":
-		t = nodeUnderlineText
-	default:
-		t = nodeInvalidTag
-		p.addError(errInvalidTagName)
+	name := string(p.frame)
+	tagNodeTypes := blockTagNodeTypes
+	if p.currentNode().Typ == NodeInlineTag {
+		tagNodeTypes = inlineTagNodeTypes
+	}
+	p.currentNode().tag = name
+	t, ok := tagNodeTypes[strings.ToLower(name)]
+	if !ok {
+		t = NodeInvalidTag
+		p.addDiagnostic(SeverityError, errInvalidTagName, " '"+name+"'", suggestTagName(name, tagNodeTypes))
 	}
 	p.currentNode().Typ = t
 	p.nodeType = t
 }
-
-func (p *Parser) appendAttr() {
-	if len(p.frame) > 0 {
-		attrs := &p.currentNode().Attrs
-		*attrs = append(*attrs, string(p.frame))
-	}
-}
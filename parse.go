@@ -1,63 +1,93 @@
 package opalparser
 
 import (
-	"io/ioutil"
+	"bufio"
+	"bytes"
+	"io"
+	"os"
 	"strings"
 	"unicode"
 )
 
 // Parser is used to parse Opal documents
+//
+// Each call to Parse or ParseFile produces a fresh document, replacing the previous one.
+// A Parser must not be used by multiple goroutines at once, but it can be reused through
+// a sync.Pool by calling Reset before putting it back. Documents never share state with
+// the parser that produced them, so they are safe to keep and render concurrently.
 type Parser struct {
-	input             []rune     // the string input containing markup
-	filepath          string     // the file path to the markup file
-	char              rune       // the current character
-	frame             []rune     // the current sliding window selection
-	len               int        // the length of the string input
-	start             int        // the start of the sliding window
-	pos               int        // the end of the sliding window (current position)
-	ln                int        // the line number
-	col               int        // the column number (position within line)
-	startLn           int        // the starting line of a node
-	startCol          int        // the starting column of a node
-	firstSpace        rune       // stores the first encountered space in a set of whitespace
-	linesHere         int        // stores the number of lines encountered through a set of whitespace
-	ignoreChar        bool       // switch to deciding if the current character should be ignored
-	parseFn           parseFn    // the current parse function
-	tree              []*Node    // the abstract syntax tree
-	nodeStack         []*Node    // a stack of nodes
-	nodeType          nodeType   // the nodeType of the current parent node
-	nodesParsedLinear []nodeType // an array of all detected nodeTypes in the order they appear
+	src               *bufio.Reader // the source of the markup, decoded one character at a time
+	buf               *bufio.Reader // the buffer reused for sources that are not buffered already
+	readErr           error         // the first error encountered reading from the source
+	filepath          string        // the file path to the markup file
+	char              rune          // the current character
+	frame             []rune        // the current sliding window selection
+	start             int           // the start of the sliding window
+	pos               int           // the end of the sliding window (current position)
+	ln                int           // the line number
+	col               int           // the column number (position within line)
+	startLn           int           // the starting line of a node
+	startCol          int           // the starting column of a node
+	offset            int           // the byte offset of the current character
+	width             int           // the width in bytes of the current character
+	startOffset       int           // the starting byte offset of a node
+	firstSpace        rune          // stores the first encountered space in a set of whitespace
+	spaceRun          []rune        // stores the raw set of whitespace the current character was collapsed from
+	linesHere         int           // stores the number of lines encountered through a set of whitespace
+	ignoreChar        bool          // switch to deciding if the current character should be ignored
+	preserve          bool          // switch to deciding if whitespace is kept as it appears in the input
+	holdLine          bool          // switch to stop collapsing whitespace at the next newline, leaving the following line unread
+	parseFn           parseFn       // the current parse function
+	tree              []*Node       // the abstract syntax tree
+	nodeStack         []*Node       // a stack of nodes
+	nodeType          NodeType      // the type of the current parent node
+	nodesParsedLinear []NodeType    // an array of all detected node types in the order they appear
+	doc               *Document     // the most recently parsed document
 }
 
 // New is used to create a new parser
 func New() *Parser {
-	return &Parser{
-		pos:      -1,
-		ln:       1,
-		col:      0,
-		startCol: 1,
-		startLn:  1,
-	}
+	p := &Parser{}
+	p.Reset()
+	return p
 }
 
-// Parse is used to parse a raw string input of Opal markup
-func (p *Parser) Parse(input string) {
-	p.input = []rune(input)
-	p.len = len(p.input)
-	p.parseFn = parseBegin
+// Reset discards all state from previous parses, including the most recently parsed
+// document, while keeping allocated buffers for reuse
+// documents returned by earlier parses are not affected
+func (p *Parser) Reset() {
+	// drop references to nodes of previous documents
+	stack := p.nodeStack[:cap(p.nodeStack)]
+	for i := range stack {
+		stack[i] = nil
+	}
 
-	p.createNode(nodeRoot)
-	p.next()
+	// drop the reference to the previous source
+	if p.buf != nil {
+		p.buf.Reset(nil)
+	}
 
-	for p.parseFn != nil {
-		p.parseFn = p.parseFn(p)
+	*p = Parser{
+		buf:               p.buf,
+		frame:             p.frame[:0],
+		pos:               -1,
+		ln:                1,
+		col:               0,
+		startCol:          1,
+		startLn:           1,
+		nodeStack:         stack[:0],
+		nodesParsedLinear: p.nodesParsedLinear[:0],
 	}
+}
 
-	// add to tree
-	p.addToParent()
+// Parse is used to parse a raw string input of Opal markup
+// the result is available through Document, Tree and the output formats
+func (p *Parser) Parse(input string) {
+	p.parse(strings.NewReader(input), "")
 }
 
 // ParseFile is used to parse files containing Opal markup
+// it panics if the file cannot be read, use the package level ParseFile to handle the error instead
 func (p *Parser) ParseFile(filein string) {
 	// f, err := os.Create("cpuprofile")
 	// if err != nil {
@@ -70,12 +100,76 @@ func (p *Parser) ParseFile(filein string) {
 	// }
 	// defer pprof.StopCPUProfile()
 
-	b, err := ioutil.ReadFile(filein)
-	if err != nil {
+	if _, err := p.parseFile(filein); err != nil {
 		panic(err)
 	}
-	p.filepath = filein
-	p.Parse(string(b))
+}
+
+// Document returns the most recently parsed document
+func (p *Parser) Document() *Document {
+	return p.doc
+}
+
+// parse resets the parser, then parses the markup read from src and returns the resulting document
+func (p *Parser) parse(src io.Reader, filepath string) *Document {
+	p.Reset()
+	rd, ok := src.(*bufio.Reader)
+	if !ok {
+		if p.buf == nil {
+			p.buf = bufio.NewReader(src)
+		} else {
+			p.buf.Reset(src)
+		}
+		rd = p.buf
+	}
+	p.src = rd
+	p.filepath = filepath
+	p.parseFn = parseBegin
+
+	p.createNode(NodeRoot)
+	p.next()
+
+	for p.parseFn != nil {
+		p.parseFn = p.parseFn(p)
+	}
+
+	// close container blocks missing their .end line
+	for len(p.nodeStack) > 1 {
+		if n := p.currentNode(); isContainer(n.Typ) {
+			p.addNodeDiagnostic(n, SeverityError, errNoEnd, "")
+		}
+		p.addToParent()
+	}
+
+	root := p.currentNode()
+	p.resolveAnchors(root)
+	p.resolveFootnotes(root)
+	root.Meta = p.parseMeta(root)
+	p.doc = &Document{Root: root, Diagnostics: root.Diagnostics, File: filepath, Meta: root.Meta}
+
+	// add to tree
+	p.addToParent()
+
+	return p.doc
+}
+
+// parseReader parses the markup read from r, only a failure to read from r is returned
+func (p *Parser) parseReader(r io.Reader, filepath string) (*Document, error) {
+	doc := p.parse(r, filepath)
+	if p.readErr != nil {
+		return nil, p.readErr
+	}
+	return doc, nil
+}
+
+// parseFile reads and parses a file, only a failure to read the file is returned
+func (p *Parser) parseFile(filein string) (*Document, error) {
+	f, err := os.Open(filein)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return p.parseReader(f, filein)
 }
 
 // flattenFrame brings the start of the frame up the current position
@@ -84,22 +178,46 @@ func (p *Parser) flattenFrame() {
 	p.start = p.pos
 	p.startCol = p.col
 	p.startLn = p.ln
-	p.frame = []rune{}
+	p.startOffset = p.offset
+	p.frame = p.frame[:0]
+}
+
+// peek returns the next character of the source without advancing, or eof
+func (p *Parser) peek() rune {
+	r, _, err := p.src.ReadRune()
+	if err != nil {
+		if err != io.EOF && p.readErr == nil {
+			p.readErr = err
+		}
+		return eof
+	}
+	p.src.UnreadRune()
+	return r
 }
 
 // next is used to advance the parsing state
 func (p *Parser) next() {
-	// add current character to frame
+	// add current character to frame, or the whitespace it was collapsed from
 	if p.char != 0 && !p.ignoreChar {
-		p.frame = append(p.frame, p.char)
+		if p.preserve && unicode.IsSpace(p.char) && len(p.spaceRun) > 0 {
+			p.frame = append(p.frame, p.spaceRun...)
+		} else {
+			p.frame = append(p.frame, p.char)
+		}
 	}
 
 repeat:
 
-	// check for eof
-	if p.pos >= p.len-1 {
+	// get new char, check for eof
+	char, width, err := p.src.ReadRune()
+	if err != nil {
+		if err != io.EOF && p.readErr == nil {
+			p.readErr = err
+		}
 		p.char = eof
 		p.pos++
+		p.offset += p.width
+		p.width = 0
 		return
 	}
 
@@ -107,8 +225,13 @@ repeat:
 	p.pos++
 	p.col++
 
-	// get new char
-	p.char = p.input[p.pos]
+	p.char = char
+	p.offset += p.width
+	p.width = width
+
+	if !unicode.IsSpace(p.char) {
+		p.spaceRun = p.spaceRun[:0]
+	}
 
 	// handle newlines
 	if p.char == charNewline {
@@ -128,12 +251,19 @@ repeat:
 		// store first encountered whitespace to set as char afterwards
 		if p.firstSpace == 0 {
 			p.firstSpace = p.char
+			p.spaceRun = p.spaceRun[:0]
 		}
+		p.spaceRun = append(p.spaceRun, p.char)
 		if p.char == charNewline {
 			p.firstSpace = charNewline
+			if p.holdLine {
+				p.holdLine = false
+				p.firstSpace, p.linesHere = 0, 0
+				return
+			}
 		}
 		// lookahead by 1, check for space
-		if p.pos+1 < p.len && unicode.IsSpace(p.input[p.pos+1]) {
+		if unicode.IsSpace(p.peek()) {
 			goto repeat
 		}
 		// if 2 or more newlines have been encountered, set char to terminator
@@ -146,13 +276,126 @@ repeat:
 	p.firstSpace, p.linesHere = 0, 0
 }
 
+// peekKeyword returns the keyword starting at the current character without advancing the parser
+func (p *Parser) peekKeyword() string {
+	keyword := []rune{p.char}
+	b, _ := p.src.Peek(16)
+	for _, c := range string(b) {
+		if !unicode.IsLetter(c) && !unicode.IsNumber(c) {
+			break
+		}
+		keyword = append(keyword, c)
+	}
+	return string(keyword)
+}
+
+// nextRaw advances the parser by a single character without collapsing whitespace or
+// detecting terminators, it returns eof at the end of the input
+func (p *Parser) nextRaw() rune {
+	char, width, err := p.src.ReadRune()
+	if err != nil {
+		if err != io.EOF && p.readErr == nil {
+			p.readErr = err
+		}
+		p.char = eof
+		p.offset += p.width
+		p.width = 0
+		return eof
+	}
+	p.pos++
+	p.col++
+	p.offset += p.width
+	p.width = width
+	if char == charNewline {
+		p.ln++
+		p.col = 0
+	}
+	p.char = char
+	return char
+}
+
+// atLineEnd reports whether the current character ends a line, including
+// terminators collapsed from a set of whitespace containing a newline
+func (p *Parser) atLineEnd() bool {
+	switch p.char {
+	case charNewline:
+		return true
+	case terminator:
+		for _, c := range p.spaceRun {
+			if c == charNewline {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spaceAfterNewline returns the whitespace the current character was collapsed from
+// following its first newline, i.e. the indentation of the next line
+func (p *Parser) spaceAfterNewline() []rune {
+	for i, c := range p.spaceRun {
+		if c == charNewline {
+			return append([]rune(nil), p.spaceRun[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// atBlockEnd reports whether the current character is a newline followed by a `.end` line
+// closing an open container block
+func (p *Parser) atBlockEnd() bool {
+	if p.char != charNewline || !p.inContainer() {
+		return false
+	}
+	b, _ := p.src.Peek(len(".end") + 1)
+	if !bytes.HasPrefix(b, []byte(".end")) {
+		return false
+	}
+	return len(b) == len(".end") || unicode.IsSpace(rune(b[len(".end")])) || rune(b[len(".end")]) == charSemicolon
+}
+
+// atInlineTag reports whether the current character is a grave opening an inline tag within the text of another,
+// rather than closing it, the grave being followed directly by the name of an inline tag and whitespace or attributes,
+// and preceded by whitespace or beginning the text of the tag
+func (p *Parser) atInlineTag() bool {
+	if p.char != charGrave {
+		return false
+	}
+	if len(p.frame) == 0 && len(p.currentNode().Children) > 0 || len(p.frame) > 0 && !p.frameEndsInSpace() {
+		return false
+	}
+	b, _ := p.src.Peek(maxInlineTagName + 1)
+	i := 0
+	for i < len(b) && (unicode.IsLetter(rune(b[i])) || unicode.IsDigit(rune(b[i]))) {
+		i++
+	}
+	if i == 0 || i == len(b) {
+		return false
+	}
+	if _, ok := inlineTagNodeTypes[strings.ToLower(string(b[:i]))]; !ok {
+		return false
+	}
+	return unicode.IsSpace(rune(b[i])) || rune(b[i]) == charSlash
+}
+
+// inContainer reports whether a container block is open
+func (p *Parser) inContainer() bool {
+	for _, n := range p.nodeStack {
+		if isContainer(n.Typ) {
+			return true
+		}
+	}
+	return false
+}
+
 // nextFlat calls `next` then flattens the frame
 func (p *Parser) nextFlat() {
 	p.next()
 	p.flattenFrame()
 }
 
-// nextUntil advances the parser until one of the destination options are encountered
+// nextUntil advances the parser until one of the destination options are encountered, or the end of a container block
+// if the options include a backslash, it also stops at hard line breaks, a backslash ending a line
 func (p *Parser) nextUntil(destinationOptions string) {
 	if p.char == eof || p.char == terminator {
 		return
@@ -162,9 +405,16 @@ func (p *Parser) nextUntil(destinationOptions string) {
 		switch p.char {
 		case eof, terminator:
 			return
+		case charNewline:
+			if p.atBlockEnd() {
+				return
+			}
 		case charBackslash:
-			if p.pos+1 < p.len {
-				escapeChar := p.input[p.pos+1]
+			escapeChar := p.peek()
+			if (escapeChar == charNewline || escapeChar == '\r') && strings.ContainsRune(destinationOptions, charBackslash) {
+				return
+			}
+			if escapeChar != eof {
 				p.ignoreChar = true
 				p.next()
 				p.ignoreChar = false
@@ -196,6 +446,86 @@ func (p *Parser) nextOverKeyword() bool {
 	}
 }
 
+// nextOverAttrValue advances the parser over the value of a key/value attribute, adding it to the frame
+// values containing whitespace, slashes or colons are quoted with single or double quotes,
+// within which a backslash escapes the following character
+// it returns false if a quoted value is not closed on the same line, or before the end of an inline tag
+func (p *Parser) nextOverAttrValue() bool {
+	if quote := p.char; quote == charQuote || quote == charApostrophe {
+		p.ignoreChar = true
+		p.next()
+		p.ignoreChar = false
+		for {
+			p.nextUntil(string(quote) + "\n`")
+			// a semicolon within quotes is not a terminator
+			if p.char != terminator || len(p.spaceRun) > 0 {
+				break
+			}
+			p.char = charSemicolon
+			p.next()
+		}
+		if p.char != quote {
+			p.addDiagnostic(SeverityError, errUnterminatedQuote, "", "")
+			return false
+		}
+		// skip over the closing quote, leaving the value in the frame
+		p.ignoreChar = true
+		p.next()
+		p.ignoreChar = false
+		return true
+	}
+	for {
+		switch p.char {
+		case eof, terminator, charSlash, charColon, charGrave:
+			return true
+		}
+		if unicode.IsSpace(p.char) {
+			return true
+		}
+		p.next()
+	}
+}
+
+// nextOverMath moves over TeX up to one of the destination characters, keeping its backslashes
+// as written, a backslash only escaping a grave, and its semicolons rather than treating them as terminators
+func (p *Parser) nextOverMath(destinationOptions string) {
+	for {
+		switch p.char {
+		case eof:
+			return
+		case terminator:
+			// a terminator collapsed from blank lines ends the TeX
+			if len(p.spaceRun) > 0 {
+				return
+			}
+			p.char = charSemicolon
+		case charNewline:
+			if p.atBlockEnd() {
+				return
+			}
+		case charBackslash:
+			p.next()
+			switch p.char {
+			case eof:
+				return
+			case charGrave:
+				p.frame = p.frame[:len(p.frame)-1]
+			case terminator:
+				if len(p.spaceRun) > 0 {
+					return
+				}
+				p.char = charSemicolon
+			}
+			p.next()
+			continue
+		}
+		if strings.ContainsRune(destinationOptions, p.char) {
+			return
+		}
+		p.next()
+	}
+}
+
 func (p *Parser) skipWhitespace() {
 	if unicode.IsSpace(rune(p.char)) {
 		p.next()
@@ -212,6 +542,19 @@ func (p *Parser) skipWhitespace() {
 // 	}
 // }
 
+// frameValue returns the content of the frame as the value of a node
+func (p *Parser) frameValue() string {
+	if p.preserve {
+		return string(p.frame)
+	}
+	return trim(string(p.frame))
+}
+
+// frameEndsInSpace reports whether the frame ends with whitespace
+func (p *Parser) frameEndsInSpace() bool {
+	return len(p.frame) > 0 && unicode.IsSpace(p.frame[len(p.frame)-1])
+}
+
 func trim(s string) string {
 	return strings.ReplaceAll(strings.TrimSpace(s), "\n", " ")
 }
@@ -1,39 +1,51 @@
 package opalparser
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 )
 
 type ParsingTest struct {
 	rawMarkup     string
-	expectedNodes []nodeType
+	expectedNodes []NodeType
 }
 
 var parsingTests = []ParsingTest{
-	{"", []nodeType{nodeRoot}},
-	{"Foo bar baz", []nodeType{nodeRoot, nodeParagraph, nodeText}},
-	{"Foo; bar; baz", []nodeType{nodeRoot, nodeParagraph, nodeText, nodeParagraph, nodeText, nodeParagraph, nodeText}},
-	{"Foo\\; bar\\; baz", []nodeType{nodeRoot, nodeParagraph, nodeText}},
-	{"Foo `b bar` baz", []nodeType{nodeRoot, nodeParagraph, nodeText, nodeInlineTag, nodeText}},
-	{"Foo \\`b bar\\` baz", []nodeType{nodeRoot, nodeParagraph, nodeText}},
-	{".1: Foo bar baz", []nodeType{nodeRoot, nodeBlockTag, nodeText}},
-	{"\\.1: Foo bar baz", []nodeType{nodeRoot, nodeParagraph, nodeText}},
-	{".1: Foo `b bar` baz", []nodeType{nodeRoot, nodeBlockTag, nodeText, nodeInlineTag, nodeText}},
-	{"Foo `l bar example.com` baz", []nodeType{nodeRoot, nodeParagraph, nodeText, nodeInlineTag, nodeText}},
-	{"Foo `l _ example.com` baz", []nodeType{nodeRoot, nodeParagraph, nodeText, nodeInlineTag, nodeText}},
+	{"", []NodeType{NodeRoot}},
+	{"Foo bar baz", []NodeType{NodeRoot, NodeParagraph, NodeText}},
+	{"Foo; bar; baz", []NodeType{NodeRoot, NodeParagraph, NodeText, NodeParagraph, NodeText, NodeParagraph, NodeText}},
+	{"Foo\\; bar\\; baz", []NodeType{NodeRoot, NodeParagraph, NodeText}},
+	{"Foo `b bar` baz", []NodeType{NodeRoot, NodeParagraph, NodeText, NodeInlineTag, NodeText}},
+	{"Foo \\`b bar\\` baz", []NodeType{NodeRoot, NodeParagraph, NodeText}},
+	{".1: Foo bar baz", []NodeType{NodeRoot, NodeBlockTag, NodeText}},
+	{"\\.1: Foo bar baz", []NodeType{NodeRoot, NodeParagraph, NodeText}},
+	{".1: Foo `b bar` baz", []NodeType{NodeRoot, NodeBlockTag, NodeText, NodeInlineTag, NodeText}},
+	{"Foo `l bar example.com` baz", []NodeType{NodeRoot, NodeParagraph, NodeText, NodeInlineTag, NodeText}},
+	{"Foo `l _ example.com` baz", []NodeType{NodeRoot, NodeParagraph, NodeText, NodeInlineTag, NodeText}},
 	{".list\n" +
 		"- foo\n" +
 		"- bar\n" +
-		"- baz", []nodeType{nodeRoot, nodeBlockTag, nodeListItem, nodeText, nodeListItem, nodeText, nodeListItem, nodeText, nodeListItem, nodeText, nodeListItem}},
+		"- baz", []NodeType{NodeRoot, NodeBlockTag, NodeListItem, NodeText, NodeListItem, NodeText, NodeListItem, NodeText}},
 	{".list\n" +
 		"- foo\n" +
 		"- `b bar`\n" +
-		"- baz", []nodeType{nodeRoot, nodeBlockTag, nodeListItem, nodeText, nodeListItem, nodeText, nodeListItem, nodeText, nodeInlineTag, nodeText, nodeListItem, nodeText, nodeListItem}},
+		"- baz", []NodeType{NodeRoot, NodeBlockTag, NodeListItem, NodeText, NodeListItem, NodeText, NodeInlineTag, NodeText, NodeListItem, NodeText}},
+	{".list\n" +
+		"- foo - bar\n" +
+		"-- baz\n" +
+		"## qux\n" +
+		"- quux", []NodeType{NodeRoot, NodeBlockTag, NodeListItem, NodeText, NodeList, NodeListItem, NodeText, NodeListItem, NodeText, NodeListItem, NodeText}},
 	{".table\n" +
 		"abc | def | ghi\n" +
 		"jkl | mno | pqr\n" +
-		"stu | vwx | yz", []nodeType{nodeRoot, nodeBlockTag, nodeTableRow, nodeTableData, nodeText, nodeTableData, nodeText, nodeTableData, nodeText, nodeTableRow, nodeTableData, nodeText, nodeTableData, nodeText, nodeTableData, nodeText, nodeTableRow, nodeTableData, nodeText, nodeTableData, nodeText, nodeTableData, nodeText, nodeTableData}},
+		"stu | vwx | yz", []NodeType{NodeRoot, NodeBlockTag, NodeTableRow, NodeTableData, NodeText, NodeTableData, NodeText, NodeTableData, NodeText, NodeTableRow, NodeTableData, NodeText, NodeTableData, NodeText, NodeTableData, NodeText, NodeTableRow, NodeTableData, NodeText, NodeTableData, NodeText, NodeTableData, NodeText}},
 }
 
 func TestParse(t *testing.T) {
@@ -48,3 +60,580 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	doc, err := Parse("Foo `x bar` baz")
+	if doc == nil {
+		t.Fatal("Expected a document, got nil")
+	}
+	var perr ParseErrors
+	if !errors.As(err, &perr) {
+		t.Fatalf("Expected ParseErrors, got: %v", err)
+	}
+	if len(perr) != 1 || perr[0].Code != "OPAL001" || perr[0].Start.Ln != 1 || perr[0].Start.Col != 6 {
+		t.Fatalf("Unexpected errors: %v", perr)
+	}
+
+	if _, err := Parse("Foo `b bar` baz"); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if _, err := ParseFile("does/not/exist.opal"); !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got: %v", err)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	doc, _ := Parse("Foo\n`bo bar` `é` baz")
+	expected := []*Diagnostic{
+		{
+			Code:     "OPAL001",
+			Severity: SeverityError,
+			Msg:      "Invalid tag name 'bo'",
+			Start:    Position{Ln: 2, Col: 2, Offset: 5},
+			End:      Position{Ln: 2, Col: 4, Offset: 7},
+			TagName:  "bo",
+			Fix:      "b",
+		},
+		{
+			Code:     "OPAL001",
+			Severity: SeverityError,
+			Msg:      "Invalid tag name 'é'",
+			Start:    Position{Ln: 2, Col: 11, Offset: 14},
+			End:      Position{Ln: 2, Col: 12, Offset: 16},
+			TagName:  "é",
+		},
+		{
+			Code:     "OPAL002",
+			Severity: SeverityError,
+			Msg:      "Unexpected character '`'",
+			Start:    Position{Ln: 2, Col: 12, Offset: 16},
+			End:      Position{Ln: 2, Col: 12, Offset: 16},
+			TagName:  "é",
+		},
+	}
+	if !reflect.DeepEqual(doc.Diagnostics, expected) {
+		for _, d := range doc.Diagnostics {
+			t.Logf("%+v", *d)
+		}
+		t.Fatalf("Unexpected diagnostics")
+	}
+	if strings.Contains(doc.JSON(), `"errors"`) {
+		t.Fatalf("Expected errors to be serialised only as diagnostics, got: %s", doc.JSON())
+	}
+}
+
+func TestNodeTypeText(t *testing.T) {
+	for i := range nodeTypeNames {
+		typ := NodeType(i)
+		b, err := typ.MarshalText()
+		if err != nil {
+			t.Fatalf("Expected %d to marshal, got: %v", i, err)
+		}
+		var got NodeType
+		if err := got.UnmarshalText(b); err != nil || got != typ {
+			t.Fatalf("Expected %v to round trip, got: %v, %v", typ, got, err)
+		}
+	}
+	var got NodeType
+	if err := got.UnmarshalText([]byte("title")); err != nil || got != NodeTitle {
+		t.Fatalf("Expected title to unmarshal as %v, got: %v, %v", NodeTitle, got, err)
+	}
+}
+
+func TestParseReader(t *testing.T) {
+	spec, err := ioutil.ReadFile("spec.opal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := []string{string(spec), "Foo\xffbar `b baz` \\"}
+	for _, test := range parsingTests {
+		inputs = append(inputs, test.rawMarkup)
+	}
+
+	for _, input := range inputs {
+		expected, _ := Parse(input)
+		doc, err := ParseReader(iotest.OneByteReader(strings.NewReader(input)))
+		if doc == nil {
+			t.Fatalf("Expected a document for %q, got: %v", input, err)
+		}
+		if doc.JSON() != expected.JSON() {
+			t.Fatalf("Expected the same tree for %q, got: %s", input, doc.JSON())
+		}
+	}
+
+	if _, err := ParseReader(iotest.TimeoutReader(strings.NewReader("Foo bar baz"))); err != iotest.ErrTimeout {
+		t.Fatalf("Expected a timeout error, got: %v", err)
+	}
+}
+
+func TestParserReuse(t *testing.T) {
+	p := New()
+	p.Parse("Foo `x bar` baz")
+	first := p.Document()
+	p.Parse("Foo bar baz")
+
+	if len(p.Tree()) != 1 || p.Tree()[0] != p.Document().Root {
+		t.Fatalf("Expected a single root, got: %v", p.Tree())
+	}
+	if p.Document().Err() != nil {
+		t.Fatalf("Expected no errors, got: %v", p.Document().Err())
+	}
+	if first.Err() == nil || len(first.Root.Children) != 1 {
+		t.Fatalf("Expected the first document to be unaffected, got: %s", first.JSON())
+	}
+
+	p.Reset()
+	if p.Document() != nil || len(p.Tree()) != 0 {
+		t.Fatalf("Expected reset to discard the document")
+	}
+}
+
+func TestParseConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, test := range parsingTests {
+				doc, _ := Parse(test.rawMarkup)
+				expected := New()
+				expected.Parse(test.rawMarkup)
+				if doc.JSON() != expected.JSON() {
+					t.Errorf("Expected the same tree for %q, got: %s", test.rawMarkup, doc.JSON())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestToC(t *testing.T) {
+	doc, _ := Parse(".1: Intro\n\n.2: Foo `b bar`\n\n.3: Baz\n\n.2: Intro\n\n.1: Intro\n\n.1: Intro 1\n\n.1: ?!")
+	expected := []*ToCEntry{
+		{Level: 1, Text: "Intro", ID: "intro", Children: []*ToCEntry{
+			{Level: 2, Text: "Foo bar", ID: "foo-bar", Children: []*ToCEntry{
+				{Level: 3, Text: "Baz", ID: "baz"},
+			}},
+			{Level: 2, Text: "Intro", ID: "intro-1"},
+		}},
+		{Level: 1, Text: "Intro", ID: "intro-2"},
+		{Level: 1, Text: "Intro 1", ID: "intro-1-1"},
+		{Level: 1, Text: "?!", ID: "section"},
+	}
+	if toc := doc.ToC(); !reflect.DeepEqual(toc, expected) {
+		t.Fatalf("Unexpected table of contents: %s", mustJSON(toc))
+	}
+}
+
+func mustJSON(v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func TestRefs(t *testing.T) {
+	doc, _ := Parse(".1/id=intro: Introduction\n\n.2: Intro\n\n.2/id=intro: Again\n\nSee `ref intro`, `ref Again` and `ref missing`.")
+	var ids, refs []string
+	walkNodes(doc.Root, func(n *Node) {
+		switch n.Typ {
+		case NodeHeading:
+			ids = append(ids, n.ID)
+		case NodeRef:
+			refs = append(refs, n.DisplayText+" "+n.URL)
+		}
+	})
+	if expected := []string{"intro", "intro-1", "again"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected heading IDs %v, got: %v", expected, ids)
+	}
+	if expected := []string{"Introduction #intro", "Again #again", "missing "}; !reflect.DeepEqual(refs, expected) {
+		t.Fatalf("Expected references %q, got: %q", expected, refs)
+	}
+
+	var codes []string
+	for _, d := range doc.Diagnostics {
+		codes = append(codes, d.Code+" "+d.Severity.String())
+	}
+	if expected := []string{"OPAL008 warning", "OPAL009 warning"}; !reflect.DeepEqual(codes, expected) {
+		t.Fatalf("Expected diagnostics %v, got: %v", expected, codes)
+	}
+	if doc.Err() != nil {
+		t.Fatalf("Expected warnings not to be errors, got: %v", doc.Err())
+	}
+}
+
+func TestCodeBlock(t *testing.T) {
+	doc, _ := Parse(".code/go\n\n  func main() {\n\n\tfmt.Println(\"a; `b` \\\\\")\n  }\n.end\n\nFoo `c bar`")
+	code := doc.Root.Children[0]
+	expected := "\n  func main() {\n\n\tfmt.Println(\"a; `b` \\\\\")\n  }"
+	if code.Typ != NodeCodeBlock || code.Value != expected || codeLanguage(code) != "go" {
+		t.Fatalf("Expected a go code block containing %q, got: %s", expected, code.Value)
+	}
+	if len(doc.Root.Children) != 2 || doc.Root.Children[1].Typ != NodeParagraph {
+		t.Fatalf("Expected parsing to continue after the code block, got: %s", doc.JSON())
+	}
+
+	doc, _ = Parse(".code  \r\n\n\n  foo\r\n\n.end\n\n.meta \n\n  bar\n.end")
+	if v := doc.Root.Children[0].Value; v != "\n\n  foo\r\n" {
+		t.Fatalf("Expected the lines following the tag line as written, got: %q", v)
+	}
+	if v := doc.Root.Children[1].Value; v != "\n  bar" {
+		t.Fatalf("Expected the lines following the tag line as written, got: %q", v)
+	}
+
+	doc, _ = Parse(".code\n.meta\n  \\.end\n\\\\.end\n.end")
+	if v := doc.Root.Children[0].Value; len(doc.Root.Children) != 1 || v != ".meta\n  .end\n\\.end" {
+		t.Fatalf("Expected escaped .end lines to be kept without their first backslash, got: %q", v)
+	}
+
+	doc, err := Parse(".code\nfoo")
+	if doc.Root.Children[0].Value != "foo" || len(doc.Errors()) != 1 || doc.Errors()[0].Code != "OPAL010" {
+		t.Fatalf("Expected a missing .end error, got: %v", err)
+	}
+}
+
+func TestWhitespace(t *testing.T) {
+	doc, _ := Parse("Jane Doe\\\n1 Main St")
+	para := doc.Root.Children[0]
+	if len(para.Children) != 3 || para.Children[1].Typ != NodeLineBreak || para.Children[2].Value != "1 Main St" {
+		t.Fatalf("Expected a hard line break, got: %s", doc.JSON())
+	}
+
+	doc, _ = Parse(".p/pre\n  roses  are\n    violets\tblue\n\nFoo   bar")
+	if text := doc.Root.Children[0].Text(); text != "  roses  are\n    violets\tblue" {
+		t.Fatalf("Expected whitespace to be preserved, got: %q", text)
+	}
+	if text := doc.Root.Children[1].Text(); text != "Foo bar" {
+		t.Fatalf("Expected whitespace to be collapsed after a pre paragraph, got: %q", text)
+	}
+}
+
+func TestNestedList(t *testing.T) {
+	doc, _ := Parse(".list\n- foo - bar\n  baz\n-- qux\n--- quux\n## corge\n- grault")
+	list := doc.Root.Children[0]
+	if len(list.Children) != 2 || list.Children[0].Children[0].Value != "foo - bar baz" || list.Children[1].Text() != "grault" {
+		t.Fatalf("Expected 2 top level items, got: %s", doc.JSON())
+	}
+	nested := list.Children[0].Children[1]
+	if nested.Typ != NodeList || len(nested.Children) != 2 || listNumbered(nested) {
+		t.Fatalf("Expected a nested bullet list of 2 items, got: %s", doc.JSON())
+	}
+	if deepest := nested.Children[0].Children[1]; deepest.Typ != NodeList || deepest.Children[0].Text() != "quux" {
+		t.Fatalf("Expected a list nested 2 levels deep, got: %s", doc.JSON())
+	}
+	if numbered := nested.Children[1]; numbered.Text() != "corge" {
+		t.Fatalf("Expected a numbered marker to continue the nested list, got: %s", doc.JSON())
+	}
+
+	doc, _ = Parse(".list\n# foo\n## bar")
+	if list := doc.Root.Children[0]; !listNumbered(list) || !listNumbered(list.Children[0].Children[1]) {
+		t.Fatalf("Expected numbered lists, got: %s", doc.JSON())
+	}
+
+	doc, _ = Parse(".list\n- item 1\n-- item 1.1\n### item 1.1.1\n- item 2\n# item 3")
+	list = doc.Root.Children[0]
+	nested = list.Children[0].Children[1]
+	if len(nested.Children) != 1 || listNumbered(nested) {
+		t.Fatalf("Expected a nested bullet list of 1 item, got: %s", doc.JSON())
+	}
+	if deepest := nested.Children[0].Children[1]; deepest.Typ != NodeList || !listNumbered(deepest) || deepest.Text() != "item 1.1.1" {
+		t.Fatalf("Expected a numbered list nested 2 levels deep, got: %s", doc.JSON())
+	}
+	if len(list.Children) != 3 || listNumbered(list) {
+		t.Fatalf("Expected the first marker to decide the type of the list, got: %s", doc.JSON())
+	}
+}
+
+func TestChecklist(t *testing.T) {
+	doc, _ := Parse(".list\n- [x] foo\n- [ ] bar\n-- [X] baz\n- qux [x]\n\n.list/check\n- quux\n- [x]")
+	items := doc.Root.Children[0].Children
+	if !items[0].Task || !items[0].Checked || items[0].Text() != "foo" || !items[1].Task || items[1].Checked || items[2].Task {
+		t.Fatalf("Expected items with checkboxes to be tasks, got: %s", doc.JSON())
+	}
+	if nested := items[1].Children[1].Children[0]; !nested.Task || !nested.Checked || nested.Text() != "baz" {
+		t.Fatalf("Expected a nested task, got: %s", doc.JSON())
+	}
+	checklists := doc.Checklists()
+	if len(checklists) != 3 {
+		t.Fatalf("Expected 3 checklists, got: %v", checklists)
+	}
+	for i, expected := range [][2]int{{1, 2}, {1, 1}, {1, 2}} {
+		if c := checklists[i]; c.Completed != expected[0] || c.Total != expected[1] {
+			t.Errorf("Expected checklist %d to have %d of %d tasks completed, got: %d of %d", i, expected[0], expected[1], c.Completed, c.Total)
+		}
+	}
+	if last := doc.Root.Children[1].Children[1]; len(last.Children) != 0 {
+		t.Fatalf("Expected the checkbox to be removed from the text, got: %s", doc.JSON())
+	}
+}
+
+func TestTableSpans(t *testing.T) {
+	doc, _ := Parse(".table\nfoo | bar | baz\nqux | < | quux\n^ | ^ | corge\n\n.table\nfoo | | bar\nbaz | qux")
+	rows := doc.Root.Children[0].Children
+	if len(rows[1].Children) != 2 || len(rows[2].Children) != 1 {
+		t.Fatalf("Expected merged cells to be removed, got: %s", doc.JSON())
+	}
+	if cell := rows[1].Children[0]; cell.ColSpan != 2 || cell.RowSpan != 2 || cell.Text() != "qux" {
+		t.Fatalf("Expected a cell spanning 2 columns and 2 rows, got: %s", doc.JSON())
+	}
+	grid, cols := tableGrid(doc.Root.Children[0])
+	if cols != 3 || grid[2][0].col != 2 {
+		t.Fatalf("Expected the cell following a spanning cell to be placed in the last column, got: %v", grid)
+	}
+
+	if rows := doc.Root.Children[1].Children; len(rows[0].Children) != 3 {
+		t.Fatalf("Expected empty cells to be kept, got: %s", doc.JSON())
+	}
+	if len(doc.Diagnostics) != 1 || doc.Diagnostics[0].Code != "OPAL011" || doc.Diagnostics[0].Start.Ln != 8 || doc.Diagnostics[0].Start.Col != 1 {
+		t.Fatalf("Expected an inconsistent cell count warning, got: %v", doc.Diagnostics)
+	}
+
+	for _, src := range []string{".table\nfoo | bar\n^ | <", ".table\nfoo | <\n^ | bar"} {
+		doc, _ = Parse(src)
+		rows = doc.Root.Children[0].Children
+		if cell := rows[0].Children[0]; cell.RowSpan > 1 && cell.ColSpan > 1 || len(rows[0].Children)+len(rows[1].Children) != 3 {
+			t.Fatalf("Expected a cell marker overlapping another cell to be kept, got: %s", doc.JSON())
+		}
+		if len(doc.Diagnostics) != 1 || doc.Diagnostics[0].Code != "OPAL011" || doc.Diagnostics[0].Start.Ln != 3 {
+			t.Fatalf("Expected an overlapping cell warning, got: %v", doc.Diagnostics)
+		}
+	}
+}
+
+func TestImages(t *testing.T) {
+	doc, _ := Parse(".image/width=50%: img/foo.png | Foo `b bar`\n\nBaz `img qux quux img/corge.png` `img grault.jpg`")
+	figure := doc.Root.Children[0]
+	if width, _ := figure.attr("width"); figure.Typ != NodeFigure || figure.URL != "img/foo.png" || figure.Text() != "Foo bar" || width != "50%" {
+		t.Fatalf("Expected a figure with a caption, got: %s", doc.JSON())
+	}
+	images := doc.Root.Children[1].Children
+	if images[1].Typ != NodeImage || images[1].DisplayText != "qux quux" || images[1].URL != "img/corge.png" {
+		t.Fatalf("Expected an inline image with alt text, got: %s", doc.JSON())
+	}
+	if images[2].DisplayText != "" || images[2].URL != "grault.jpg" {
+		t.Fatalf("Expected an inline image without alt text, got: %s", doc.JSON())
+	}
+
+	doc, _ = Parse(".image\nfoo.png")
+	if figure := doc.Root.Children[0]; figure.URL != "foo.png" || len(figure.Children) != 0 {
+		t.Fatalf("Expected a figure without a caption, got: %s", doc.JSON())
+	}
+	var perr ParseErrors
+	if _, err := Parse(".image: | Foo"); !errors.As(err, &perr) || perr[0].Code != "OPAL012" {
+		t.Fatalf("Expected a missing source error, got: %v", err)
+	}
+}
+
+func TestContainers(t *testing.T) {
+	doc, _ := Parse(".note\nFoo `b bar`\n\nBaz\n.end\n\n.quote\n.list\n- qux\n.end\n\n.warning: Quux\n\n.tip\n.2: Corge\n.end")
+	note := doc.Root.Children[0]
+	if note.Typ != NodeNote || len(note.Children) != 2 || note.Children[0].Typ != NodeParagraph || note.Children[1].Text() != "Baz" {
+		t.Fatalf("Expected a note containing 2 paragraphs, got: %s", doc.JSON())
+	}
+	if len(doc.Root.Children) != 4 {
+		t.Fatalf("Expected the .end lines to close the blocks, got: %s", doc.JSON())
+	}
+	quote := doc.Root.Children[1]
+	if quote.Typ != NodeQuote || quote.Children[0].Typ != NodeList {
+		t.Fatalf("Expected a quote containing a list, got: %s", doc.JSON())
+	}
+	if warning := doc.Root.Children[2]; warning.Typ != NodeWarning || warning.Children[0].Typ != NodeParagraph || warning.Text() != "Quux" {
+		t.Fatalf("Expected a warning containing a paragraph, got: %s", doc.JSON())
+	}
+	if toc := doc.ToC(); len(toc) != 1 || toc[0].Text != "Corge" {
+		t.Fatalf("Expected headings within containers in the contents, got: %v", toc)
+	}
+
+	doc, _ = Parse(".note\n.quote\nFoo\n.end\nBar\n.end")
+	if note := doc.Root.Children[0]; len(note.Children) != 2 || note.Children[0].Typ != NodeQuote || note.Children[1].Text() != "Bar" {
+		t.Fatalf("Expected a note containing a quote, got: %s", doc.JSON())
+	}
+
+	doc, _ = Parse(".end\n\n.note\nFoo")
+	if errs := doc.Errors(); len(errs) != 2 || errs[0].Code != "OPAL013" || errs[1].Code != "OPAL010" || doc.Root.Children[0].Text() != "Foo" {
+		t.Fatalf("Expected an unexpected .end error and a missing .end error, got: %v", errs)
+	}
+}
+
+func TestFootnotes(t *testing.T) {
+	doc, _ := Parse(".p: Foo `fn bar baz` qux `fn #src` quux `fn #src` `fn #nope`;\n.fn/src: The `b source`;\n.fn/src: Again;\n.fn/spare: Unused;")
+	notes := doc.Footnotes()
+	if len(notes) != 2 || notes[0].Number != 1 || notes[0].ID != "fn-1" || notes[0].Text != "bar baz" ||
+		notes[1].Number != 2 || notes[1].ID != "fn-src" || notes[1].Text != "The source" || notes[1].Content.Typ != NodeFootnoteDef {
+		t.Fatalf("Expected 2 footnotes, got: %s", doc.JSON())
+	}
+	para := doc.Root.Children[0]
+	if ref := para.Children[5]; ref.DisplayText != "2" || ref.URL != "#fn-src" || ref.ID != "fnref-2-2" {
+		t.Fatalf("Expected a repeated reference to the named note, got: %+v", ref)
+	}
+	if text := para.Text(); text != "Foo qux quux" {
+		t.Fatalf("Expected footnotes to be left out of the text, got: %q", text)
+	}
+	var codes []string
+	for _, d := range doc.Diagnostics {
+		codes = append(codes, d.Code)
+	}
+	if strings.Join(codes, " ") != "OPAL015 OPAL014 OPAL016" {
+		t.Fatalf("Expected undefined, duplicate and unused footnote warnings, got: %v", doc.Diagnostics)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	doc, _ := Parse(".meta\nAuthor: Foo\ndescription: Bar: baz\ndate: 2024-02-30\nkeywords: qux, , quux\nlang: en\nstatus: draft\ncorge\n.end\n\n.Title: Grault")
+	want := &Meta{Author: "Foo", Subject: "Bar: baz", Date: "2024-02-30", Tags: []string{"qux", "quux"}, Language: "en", Extra: map[string]string{"status": "draft"}}
+	if !reflect.DeepEqual(doc.Meta, want) || doc.Root.Meta != doc.Meta {
+		t.Fatalf("Expected %+v, got: %+v", want, doc.Meta)
+	}
+	if len(doc.Diagnostics) != 2 || doc.Diagnostics[0].Code != "OPAL018" || doc.Diagnostics[1].Code != "OPAL017" {
+		t.Fatalf("Expected an invalid date and a malformed line warning, got: %v", doc.Diagnostics)
+	}
+	if title := doc.title(); title != "Grault" {
+		t.Fatalf("Expected the title to default to the title block, got: %q", title)
+	}
+	if doc, _ := Parse("Foo"); doc.Meta != nil || strings.Contains(doc.JSON(), "meta") {
+		t.Fatalf("Expected no metadata, got: %+v", doc.Meta)
+	}
+}
+
+func TestAttrs(t *testing.T) {
+	doc, _ := Parse(".list/n/start=5\n- foo\n\n.image/width=\"50%\"/alt='a \\' b; c: d': bar.png\n\n.code/lang=go/python\nbaz\n.end")
+	list, figure, code := doc.Root.Children[0], doc.Root.Children[1], doc.Root.Children[2]
+	if !reflect.DeepEqual(list.Attrs, []string{"n"}) || listStart(list) != 5 {
+		t.Fatalf("Expected a numbered list starting at 5, got: %s", doc.JSON())
+	}
+	if figure.Params["width"] != "50%" || figure.Params["alt"] != "a ' b; c: d" || figure.URL != "bar.png" {
+		t.Fatalf("Expected quoted attribute values, got: %s", doc.JSON())
+	}
+	if codeLanguage(code) != "go" {
+		t.Fatalf("Expected the lang attribute to set the language, got: %q", codeLanguage(code))
+	}
+	if len(doc.Diagnostics) != 1 || doc.Diagnostics[0].Code != "OPAL021" {
+		t.Fatalf("Expected an unknown attribute warning, got: %v", doc.Diagnostics)
+	}
+
+	doc, _ = Parse(".table/h/x/align=lx/align=l/=y/z=\nfoo | bar\n\n.1/id=\"baz\nqux")
+	var codes []string
+	for _, d := range doc.Diagnostics {
+		codes = append(codes, d.Code)
+	}
+	if strings.Join(codes, " ") != "OPAL021 OPAL022 OPAL023 OPAL019 OPAL019 OPAL020" {
+		t.Fatalf("Expected malformed and unknown attribute diagnostics, got: %v", doc.Diagnostics)
+	}
+	if table := doc.Root.Children[0]; table.Params["align"] != "lx" || len(table.Children) != 1 {
+		t.Fatalf("Expected the table to be parsed, got: %s", doc.JSON())
+	}
+}
+
+func TestInlineAttrs(t *testing.T) {
+	doc, _ := Parse("Foo `l/newtab/class=bar baz qux.com` `c/lang=\"sql\" SELECT 1` `u/x quux`")
+	para := doc.Root.Children[0]
+	link, code := para.Children[1], para.Children[2]
+	if !reflect.DeepEqual(link.Attrs, []string{"newtab"}) || link.Params["class"] != "bar" || link.DisplayText != "baz" || link.URL != "qux.com" {
+		t.Fatalf("Expected a link with attributes, got: %s", doc.JSON())
+	}
+	if code.Params["lang"] != "sql" || code.Value != "SELECT 1" {
+		t.Fatalf("Expected a code span with a language, got: %s", doc.JSON())
+	}
+	if len(doc.Diagnostics) != 1 || doc.Diagnostics[0].Code != "OPAL021" || !strings.Contains(doc.Diagnostics[0].Msg, "`u") {
+		t.Fatalf("Expected an unknown attribute warning, got: %v", doc.Diagnostics)
+	}
+
+	doc, _ = Parse("Foo `b/class=\"bar baz`")
+	if errs := doc.Errors(); len(errs) == 0 || errs[0].Code != "OPAL020" {
+		t.Fatalf("Expected an unterminated quote error, got: %v", errs)
+	}
+}
+
+func TestNestedInline(t *testing.T) {
+	doc, err := Parse("Foo `b bar `l baz `i qux` quux.com` corge` `bi grault` `c garply \\`b`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	para := doc.Root.Children[0]
+	bold := para.Children[1]
+	if bold.Typ != NodeBoldText || bold.Value != "" || len(bold.Children) != 3 || bold.Children[2].Value != "corge" {
+		t.Fatalf("Expected bold text containing a link, got: %s", doc.JSON())
+	}
+	link := bold.Children[1]
+	if link.Typ != NodeHyperlink || link.URL != "quux.com" || len(link.Children) != 2 || link.Children[1].Typ != NodeItalicText || link.Children[1].Value != "qux" {
+		t.Fatalf("Expected a link containing italic text, got: %s", doc.JSON())
+	}
+	if combo := para.Children[2]; combo.Typ != NodeBoldItalic || combo.Value != "grault" {
+		t.Fatalf("Expected combined tags to be kept, got: %s", doc.JSON())
+	}
+	if code := para.Children[3]; code.Typ != NodeCode || code.Value != "garply `b" {
+		t.Fatalf("Expected code to be kept as written, got: %s", doc.JSON())
+	}
+	if text := para.Text(); text != "Foo bar baz qux corge grault garply `b" {
+		t.Fatalf("Expected the text of nested tags, got: %q", text)
+	}
+
+	// a grave followed by a tag name only opens a nested tag after whitespace
+	for _, src := range []string{"Use `b API`s are fine.", "It is `b 10`m wide."} {
+		doc, _ = Parse(src)
+		para = doc.Root.Children[0]
+		if len(para.Children) != 3 || para.Children[1].Typ != NodeBoldText || len(doc.Diagnostics) != 0 {
+			t.Fatalf("Expected the grave to close the bold text, got: %s", doc.JSON())
+		}
+		if !para.Children[0].SpaceAfter || !para.Children[1].SpaceBefore || para.Children[1].SpaceAfter || para.Children[2].SpaceBefore {
+			t.Fatalf("Expected the whitespace around the bold text to be recorded, got: %s", doc.JSON())
+		}
+	}
+
+	doc, _ = Parse("Foo `b bar `i baz qux\n\nquux")
+	if len(doc.Root.Children) != 2 || doc.Root.Children[0].Text() != "Foo bar baz qux" || doc.Root.Children[1].Text() != "quux" {
+		t.Fatalf("Expected tags left open to keep their text, got: %s", doc.JSON())
+	}
+	if len(doc.Diagnostics) != 2 || doc.Diagnostics[0].Code != "OPAL003" {
+		t.Fatalf("Expected an error for each tag left open, got: %v", doc.Diagnostics)
+	}
+}
+
+func TestInlineSpacing(t *testing.T) {
+	doc, _ := Parse("H`sub 2`O x `sup 2` `b y`z")
+	var tree []struct {
+		Children []struct {
+			Children []struct {
+				Value       string
+				SpaceBefore bool
+				SpaceAfter  bool
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(doc.JSON()), &tree); err != nil {
+		t.Fatal(err)
+	}
+	type spacing struct {
+		value         string
+		before, after bool
+	}
+	var got []spacing
+	for _, n := range tree[0].Children[0].Children {
+		got = append(got, spacing{n.Value, n.SpaceBefore, n.SpaceAfter})
+	}
+	expected := []spacing{{"H", false, false}, {"2", false, false}, {"O x", false, true}, {"2", true, true}, {"y", true, false}, {"z", false, false}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected the whitespace around each inline element in the JSON, got: %+v", got)
+	}
+}
+
+func TestMath(t *testing.T) {
+	doc, err := Parse("Foo `m \\frac{a}{b}; c \\` d` bar\n\n.math\n\\alpha^2 \\\\\nx\n.end\n\n.math: y \\; z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := doc.Root.Children[0].Children[1]; m.Typ != NodeMath || m.Value != "\\frac{a}{b}; c ` d" {
+		t.Fatalf("Expected inline TeX kept as written, got: %s", doc.JSON())
+	}
+	if m := doc.Root.Children[1]; m.Typ != NodeMathBlock || m.Value != "\\alpha^2 \\\\\nx" {
+		t.Fatalf("Expected a verbatim math block, got: %s", doc.JSON())
+	}
+	if m := doc.Root.Children[2]; m.Typ != NodeMathBlock || m.Value != "y \\; z" {
+		t.Fatalf("Expected a single line math block, got: %s", doc.JSON())
+	}
+	if len(doc.Diagnostics) != 0 {
+		t.Fatalf("Expected no diagnostics, got: %v", doc.Diagnostics)
+	}
+}
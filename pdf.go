@@ -0,0 +1,1080 @@
+package opalparser
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// PDF is a document rendered as PDF
+type PDF struct {
+	data []byte
+	err  error
+}
+
+// list of measurements used to lay out PDF documents
+const (
+	pdfMargin     = 20.0 // the page margin in mm
+	pdfFontSize   = 11.0 // the font size of body text in pt
+	pdfTableSize  = 10.0 // the font size of table text in pt
+	pdfCodeSize   = 9.0  // the font size of code blocks in pt
+	pdfTitleSize  = 24.0 // the font size of the title in pt
+	pdfLineFactor = 0.5  // the line height in mm per pt of font size
+	pdfIndent     = 6.0  // the indentation of each list level in mm
+	pdfCellPad    = 1.5  // the padding within table cells in mm
+	pdfBlockSpace = 3.0  // the space after each block element in mm
+	pdfCheckSize  = 3.0  // the size of task checkboxes in mm
+	pdfImageSize  = 0.35 // the height of inline images in mm per pt of font size
+	pdfNoImageH   = 20.0 // the height of the box replacing a figure whose image cannot be loaded in mm
+	pdfAccentW    = 1.0  // the width of the accent bar of container blocks in mm
+	pdfIconSize   = 4.0  // the diameter of the icons of admonitions in mm
+	pdfNoteSize   = 8.0  // the font size of footnotes in pt
+	pdfNoteRule   = 4.0  // the height of the space holding the rule above the footnotes of a page in mm
+	pdfSupScale   = 0.65 // the font size of superscripts, subscripts and footnote references relative to the surrounding text
+	pdfKbdScale   = 0.9  // the font size of keyboard input relative to the surrounding text
+	pdfKbdPad     = 0.5  // the space between keyboard input and its box in mm
+	pdfSupShift   = 0.35 // the baseline shift of superscripts and footnote references in ems of the surrounding text
+	pdfSubShift   = -0.2 // the baseline shift of subscripts in ems of the surrounding text
+	pdfMathSize   = 12.0 // the font size of display math in pt
+	pdfMinWidth   = 40.0 // the narrowest content of container blocks in mm, deeper blocks are not moved in any further
+)
+
+// list of colours used to fill the background of spans
+var (
+	pdfMarkFill = [3]int{255, 241, 118}
+	pdfKbdFill  = [3]int{240, 240, 240}
+)
+
+// pdfHeadingSizes maps heading levels to their font size in pt
+var pdfHeadingSizes = map[string]float64{
+	"1": 20,
+	"2": 16,
+	"3": 14,
+	"4": 12,
+	"5": 11,
+	"6": 11,
+}
+
+// pdfContainerStyle is the appearance of a container block
+type pdfContainerStyle struct {
+	label  string // the label of admonitions, following their icon
+	icon   string // the character within the icon
+	fill   [3]int // the colour of the box
+	accent [3]int // the colour of the accent bar, icon and label
+}
+
+// pdfContainerStyles maps container blocks to their appearance
+var pdfContainerStyles = map[NodeType]pdfContainerStyle{
+	NodeQuote:   {fill: [3]int{245, 245, 245}, accent: [3]int{160, 160, 160}},
+	NodeNote:    {label: "Note", icon: "i", fill: [3]int{232, 240, 254}, accent: [3]int{26, 115, 232}},
+	NodeWarning: {label: "Warning", icon: "!", fill: [3]int{254, 243, 224}, accent: [3]int{230, 124, 0}},
+	NodeTip:     {label: "Tip", icon: "?", fill: [3]int{230, 244, 234}, accent: [3]int{30, 142, 62}},
+}
+
+// pdfRenderer holds the state of a single PDF rendering
+type pdfRenderer struct {
+	doc       *Document
+	pdf       *gofpdf.Fpdf
+	tr        func(string) string              // translates UTF-8 text to the encoding of the core fonts
+	x         float64                          // the left edge of the content, moved in by container blocks
+	width     float64                          // the width of the content, narrowed by container blocks
+	links     map[string]int                   // the internal links to each anchor ID
+	pages     map[string]int                   // the page each anchor ID was placed on
+	tocPages  map[string]int                   // the pages of anchor IDs from a previous rendering, used by the contents
+	hasToC    bool                             // whether a table of contents was rendered
+	pageBreak bool                             // whether the next block element starts a new page
+	resolve   ImageResolver                    // opens the images of the document
+	images    map[string]*gofpdf.ImageInfoType // the registered images by source, nil if they could not be loaded
+	notes     map[string]*Footnote             // the footnotes of the document by anchor ID
+	placed    map[string]bool                  // the anchor IDs of the footnotes already placed on a page
+	pageNotes []*Footnote                      // the footnotes placed on the current page, drawn at its bottom
+	notesH    float64                          // the height reserved at the bottom of the current page for its footnotes
+	boxes     map[*Node]pdfBox                 // the measured boxes of container blocks, shared with the scratch renderers measuring them
+	unhandled []NodeType                       // the types of the nodes without a case, which are rendered as plain text or not at all
+}
+
+// pdfBox is the measured box of a container block
+type pdfBox struct {
+	h      float64 // the height of the box
+	notesH float64 // the height of the footnotes referenced within the box
+	fits   bool    // whether the box fits on a single page
+}
+
+// pdfSpan is a run of text sharing a single style
+type pdfSpan struct {
+	text   string
+	family string
+	style  string
+	size   float64
+	color  [3]int
+	link   string    // the URL the span links to, if any
+	linkID int       // the internal link the span links to, if any
+	space  bool      // whether the span is separated from the previous span by a space
+	pre    bool      // whether the whitespace of the span is kept, breaking lines only at newlines
+	brk    bool      // whether the span is a hard line break
+	image  string    // the source of the registered image the span consists of, if any
+	rise   float64   // the distance the span is raised above the line in mm, negative if lowered
+	note   *Footnote // the footnote the span refers to, if any
+	strike bool      // whether the span is struck through
+	filled bool      // whether the background of the span is filled with fill
+	fill   [3]int    // the colour of the background of the span
+	boxed  bool      // whether each word of the span is drawn within a bordered box
+	math   *mathBox  // the typeset math the span consists of, if any
+}
+
+// pdfWord is a word of a span positioned within a line
+type pdfWord struct {
+	span  *pdfSpan
+	text  string
+	width float64
+	space float64 // the width of the space preceding the word, 0 at the start of a line
+}
+
+// pdfLine is a line of words that fits within the width it was laid out for
+type pdfLine struct {
+	words []pdfWord
+	width float64
+}
+
+// PDFOptions configures the PDF output
+type PDFOptions struct {
+	// ImageResolver opens the images of the document, by default image files are opened
+	// relative to the directory of the file of documents parsed with ParseFile, see DirImageResolver,
+	// while other documents have no images embedded
+	// images that cannot be opened or decoded are replaced by their alt text or source
+	ImageResolver ImageResolver
+}
+
+// PDF renders the document as PDF
+// an error encountered while rendering is returned by the output methods of the PDF
+func (d *Document) PDF() PDF {
+	return d.PDFWith(PDFOptions{})
+}
+
+// PDFWith renders the document as PDF using the given options
+// an error encountered while rendering is returned by the output methods of the PDF
+func (d *Document) PDFWith(o PDFOptions) PDF {
+	var buf bytes.Buffer
+	err := d.pdf(o).Output(&buf)
+	if err != nil {
+		return PDF{err: err}
+	}
+	return PDF{data: buf.Bytes()}
+}
+
+// Err returns the error encountered while rendering the PDF, if any
+func (p PDF) Err() error {
+	return p.err
+}
+
+// Bytes returns the contents of the PDF
+func (p PDF) Bytes() ([]byte, error) {
+	return p.data, p.err
+}
+
+// Base64 returns the contents of the PDF encoded as standard base64
+func (p PDF) Base64() (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	return base64.StdEncoding.EncodeToString(p.data), nil
+}
+
+// WriteTo writes the contents of the PDF to w, implementing io.WriterTo
+func (p PDF) WriteTo(w io.Writer) (int64, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	n, err := w.Write(p.data)
+	return int64(n), err
+}
+
+// SaveAs writes the contents of the PDF to a file, creating or truncating it
+func (p PDF) SaveAs(filepath string) error {
+	if p.err != nil {
+		return p.err
+	}
+	return ioutil.WriteFile(filepath, p.data, 0644)
+}
+
+// pdf lays out the document on a new PDF
+func (d *Document) pdf(o PDFOptions) *gofpdf.Fpdf {
+	if o.ImageResolver == nil && d.File != "" {
+		o.ImageResolver = DirImageResolver(filepath.Dir(d.File))
+	}
+	r := newPDFRenderer(d, o, nil)
+	r.info()
+	r.blocks(d.Root)
+	r.footnotes()
+	// the contents need the page of each heading, which is only known after laying out the document
+	if r.hasToC {
+		r = newPDFRenderer(d, o, r.pages)
+		r.info()
+		r.blocks(d.Root)
+		r.footnotes()
+	}
+	return r.pdf
+}
+
+func newPDFRenderer(d *Document, o PDFOptions, tocPages map[string]int) *pdfRenderer {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(false, pdfMargin)
+	pdf.SetCellMargin(0)
+	pdf.AddPage()
+
+	pageW, _ := pdf.GetPageSize()
+	notes := map[string]*Footnote{}
+	for _, note := range d.Footnotes() {
+		notes[note.ID] = note
+	}
+	return &pdfRenderer{
+		doc:      d,
+		pdf:      pdf,
+		tr:       pdf.UnicodeTranslatorFromDescriptor(""),
+		x:        pdfMargin,
+		width:    pageW - 2*pdfMargin,
+		links:    map[string]int{},
+		pages:    map[string]int{},
+		tocPages: tocPages,
+		resolve:  o.ImageResolver,
+		images:   map[string]*gofpdf.ImageInfoType{},
+		notes:    notes,
+		placed:   map[string]bool{},
+		boxes:    map[*Node]pdfBox{},
+	}
+}
+
+// info sets the document information dictionary from the metadata of the document
+func (r *pdfRenderer) info() {
+	if title := r.doc.title(); title != "" {
+		r.pdf.SetTitle(title, true)
+	}
+	meta := r.doc.Meta
+	if meta == nil {
+		return
+	}
+	if meta.Author != "" {
+		r.pdf.SetAuthor(meta.Author, true)
+	}
+	if meta.Subject != "" {
+		r.pdf.SetSubject(meta.Subject, true)
+	}
+	if len(meta.Tags) > 0 {
+		r.pdf.SetKeywords(strings.Join(meta.Tags, ", "), true)
+	}
+	if t, ok := meta.Time(); ok {
+		r.pdf.SetCreationDate(t)
+	}
+}
+
+// blocks renders the block elements of a node
+func (r *pdfRenderer) blocks(n *Node) {
+	body := pdfSpan{family: "Arial", size: pdfFontSize}
+	for _, node := range n.Children {
+		if r.pageBreak {
+			r.newPage()
+			r.pageBreak = false
+		}
+		switch node.Typ {
+		case NodeTitle:
+			title := pdfSpan{family: "Arial", style: "B", size: pdfTitleSize}
+			r.paragraph(r.spans(node, title), r.x, r.width, "C")
+			r.space(pdfBlockSpace * 2)
+		case NodeToC:
+			r.toc()
+		case NodeHeading:
+			heading := pdfSpan{family: "Arial", style: "B", size: pdfHeadingSizes[node.Level]}
+			r.space(pdfBlockSpace)
+			r.ensureSpace(lineHeight(heading.size))
+			r.anchor(node.ID)
+			r.paragraph(r.spans(node, heading), r.x, r.width, "L")
+			r.space(pdfBlockSpace)
+		case NodeParagraph:
+			para := body
+			para.pre = node.hasAttr("pre")
+			r.paragraph(r.spans(node, para), r.x, r.width, "L")
+			r.space(pdfBlockSpace)
+		case NodeCodeBlock:
+			r.codeBlock(node)
+			r.space(pdfBlockSpace)
+		case NodeMathBlock:
+			r.mathBlock(node)
+			r.space(pdfBlockSpace)
+		case NodeFigure:
+			r.figure(node)
+			r.space(pdfBlockSpace)
+		case NodeQuote, NodeNote, NodeWarning, NodeTip:
+			r.container(node)
+			r.space(pdfBlockSpace)
+		case NodeList:
+			r.list(node, body, r.x)
+			r.space(pdfBlockSpace)
+		case NodeTable:
+			r.table(node)
+			r.space(pdfBlockSpace)
+		case NodeMeta, NodeFootnoteDef:
+			// metadata sets the document information and notes are drawn at the bottom of the pages referring to them
+		default:
+			r.unhandled = append(r.unhandled, node.Typ)
+		}
+	}
+}
+
+// spans converts the inline elements of a node into spans, combining their style with base
+func (r *pdfRenderer) spans(n *Node, base pdfSpan) []pdfSpan {
+	var spans []pdfSpan
+	for i, v := range n.Children {
+		s := base
+		s.text = v.Value
+		s.space = i > 0 && !base.pre && (n.Children[i-1].SpaceAfter || v.SpaceBefore)
+		switch v.Typ {
+		case NodeText, NodeInvalidTag:
+		case NodeList:
+			continue // nested lists are rendered by list
+		case NodeLineBreak:
+			s.brk = true
+		case NodeImage:
+			// images that cannot be loaded are replaced by their alt text, or their source
+			s.text = v.DisplayText
+			if r.image(v.URL) != nil {
+				s.image = v.URL
+			} else if s.text == "" {
+				s.text = v.URL
+			}
+		case NodeBoldText:
+			s.style = addStyle(s.style, "B")
+		case NodeItalicText:
+			s.style = addStyle(s.style, "I")
+		case NodeUnderlineText:
+			s.style = addStyle(s.style, "U")
+		case NodeBoldItalic:
+			s.style = addStyle(s.style, "BI")
+		case NodeBoldUnderline:
+			s.style = addStyle(s.style, "BU")
+		case NodeItalicUnderline:
+			s.style = addStyle(s.style, "IU")
+		case NodeCode:
+			s.family = "Courier"
+		case NodeStrikethrough:
+			s.strike = true
+		case NodeMath:
+			box := r.typesetMath(v.Value, s.size, false)
+			s.math = &box
+		case NodeSuperscript, NodeSubscript:
+			shift := pdfSupShift
+			if v.Typ == NodeSubscript {
+				shift = pdfSubShift
+			}
+			s.size = base.size * pdfSupScale
+			s.rise = pdfRise(base.size, s.size, shift)
+		case NodeHighlight:
+			s.filled, s.fill = true, pdfMarkFill
+		case NodeKeyboard:
+			s.family = "Courier"
+			s.size = base.size * pdfKbdScale
+			s.filled, s.fill, s.boxed = true, pdfKbdFill, true
+		case NodeHyperlink:
+			s.text = v.DisplayText
+			s.style = addStyle(s.style, "U")
+			s.color = [3]int{0, 0, 238}
+			s.link = v.URL
+		case NodeRef:
+			s.text = v.DisplayText
+			if v.URL != "" {
+				s.color = [3]int{0, 0, 238}
+				s.linkID = r.link(strings.TrimPrefix(v.URL, "#"))
+			}
+		case NodeFootnote:
+			// references are set as superscripts
+			s.text = v.DisplayText
+			s.size *= pdfSupScale
+			s.rise = pdfRise(base.size, s.size, pdfSupShift)
+			if note := r.notes[strings.TrimPrefix(v.URL, "#")]; note != nil {
+				s.note = note
+				s.linkID = r.link(note.ID)
+			}
+		default:
+			r.unhandled = append(r.unhandled, v.Typ)
+		}
+		// nested inline elements are combined with the style of the element containing them
+		if len(v.Children) > 0 {
+			nested := r.spans(v, s)
+			if len(nested) > 0 {
+				nested[0].space = s.space
+			}
+			spans = append(spans, nested...)
+			continue
+		}
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+// pdfRise returns the distance to raise a span of the given font size within text of the base font size
+// for its baseline to be shifted by shift ems, cells already placing the baseline of smaller text slightly higher
+func pdfRise(base, size, shift float64) float64 {
+	const mmPerPt = 25.4 / 72
+	return (shift*base - 0.3*(base-size)) * mmPerPt
+}
+
+// addStyle adds the styles of add missing from a font style
+func addStyle(style, add string) string {
+	for _, c := range add {
+		if !strings.ContainsRune(style, c) {
+			style += string(c)
+		}
+	}
+	return style
+}
+
+// setFont applies the font of a span
+func (r *pdfRenderer) setFont(s *pdfSpan) {
+	r.pdf.SetFont(s.family, s.style, s.size)
+	r.pdf.SetTextColor(s.color[0], s.color[1], s.color[2])
+}
+
+// lineHeight returns the line height of spans with the given font size
+func lineHeight(size float64) float64 {
+	return size * pdfLineFactor
+}
+
+// layout breaks spans into lines no wider than width
+// words wider than width are placed on a line of their own, and hard line breaks and the
+// newlines of preformatted spans always start a new line
+func (r *pdfRenderer) layout(spans []pdfSpan, width float64) []pdfLine {
+	var lines []pdfLine
+	var line pdfLine
+	for i := range spans {
+		s := &spans[i]
+		r.setFont(s)
+		if s.brk {
+			lines = append(lines, line)
+			line = pdfLine{}
+			continue
+		}
+		if s.pre {
+			for j, text := range strings.Split(strings.ReplaceAll(s.text, "\t", "    "), "\n") {
+				if j > 0 {
+					lines = append(lines, line)
+					line = pdfLine{}
+				}
+				text = r.tr(text)
+				word := pdfWord{span: s, text: text, width: r.pdf.GetStringWidth(text)}
+				line.words = append(line.words, word)
+				line.width += word.width
+			}
+			continue
+		}
+		spaceWidth := r.pdf.GetStringWidth(" ")
+		words := strings.Fields(r.tr(s.text))
+		if s.image != "" || s.math != nil {
+			words = []string{""}
+		}
+		for j, text := range words {
+			word := pdfWord{span: s, text: text, width: r.pdf.GetStringWidth(text)}
+			if s.image != "" {
+				iw, ih := r.images[s.image].Extent()
+				word.width = s.size * pdfImageSize * iw / ih
+			}
+			if s.math != nil {
+				word.width = s.math.width
+			}
+			if len(line.words) > 0 && (j > 0 || s.space) {
+				word.space = spaceWidth
+			}
+			if len(line.words) > 0 && line.width+word.space+word.width > width {
+				lines = append(lines, line)
+				line = pdfLine{}
+				word.space = 0
+			}
+			line.words = append(line.words, word)
+			line.width += word.space + word.width
+		}
+	}
+	if len(line.words) > 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// draw draws lines from the current vertical position, starting a new page whenever a line does not fit
+// the footnotes referenced by a line are placed at the bottom of the page the line is drawn on
+func (r *pdfRenderer) draw(lines []pdfLine, x, width, lh float64, align string) {
+	for _, line := range lines {
+		notes := r.lineNotes([]pdfLine{line})
+		r.ensureSpace(lh + r.footnotesHeight(notes))
+		r.placeFootnotes(notes)
+		y := r.pdf.GetY()
+		r.drawLine(line, x, y, width, lh, align)
+		r.pdf.SetXY(x, y+lh)
+	}
+}
+
+// lineNotes returns the footnotes referenced by the given lines which are yet to be placed on a page
+func (r *pdfRenderer) lineNotes(lines []pdfLine) []*Footnote {
+	var notes []*Footnote
+	seen := map[string]bool{}
+	for _, line := range lines {
+		for _, w := range line.words {
+			if note := w.span.note; note != nil && !r.placed[note.ID] && !seen[note.ID] {
+				notes = append(notes, note)
+				seen[note.ID] = true
+			}
+		}
+	}
+	return notes
+}
+
+// drawLine draws a line at x, y
+func (r *pdfRenderer) drawLine(line pdfLine, x, y, width, lh float64, align string) {
+	switch align {
+	case "C":
+		x += (width - line.width) / 2
+	case "R":
+		x += width - line.width
+	}
+	for i, w := range line.words {
+		// the background and strike through line of a span continue over the spaces between its words
+		bx, bw := x+w.space, w.width
+		if i > 0 && line.words[i-1].span == w.span && !w.span.boxed {
+			bx, bw = x, w.space+w.width
+		}
+		if w.span.filled {
+			r.pdf.SetFillColor(w.span.fill[0], w.span.fill[1], w.span.fill[2])
+			style := "F"
+			if w.span.boxed {
+				// leave a little space around the text within the box
+				bx, bw = bx-pdfKbdPad, bw+2*pdfKbdPad
+				style = "DF"
+				r.pdf.SetDrawColor(150, 150, 150)
+				r.pdf.SetLineWidth(0.2)
+			}
+			r.pdf.Rect(bx, y+lh*0.1, bw, lh*0.8, style)
+			r.pdf.SetDrawColor(0, 0, 0)
+		}
+		if w.span.strike {
+			c := w.span.color
+			r.pdf.SetDrawColor(c[0], c[1], c[2])
+			r.pdf.SetLineWidth(w.span.size * 0.05 * pdfLineFactor)
+			r.pdf.Line(bx, y+lh/2-w.span.rise, bx+bw, y+lh/2-w.span.rise)
+			r.pdf.SetDrawColor(0, 0, 0)
+			r.pdf.SetLineWidth(0.2)
+		}
+		x += w.space
+		if w.span.image != "" {
+			h := w.span.size * pdfImageSize
+			r.pdf.ImageOptions(w.span.image, x, y+(lh-h)/2, w.width, h, false, gofpdf.ImageOptions{}, w.span.linkID, w.span.link)
+			x += w.width
+			continue
+		}
+		if w.span.math != nil {
+			// place the baseline of the math where cells place the baseline of text
+			const mmPerPt = 25.4 / 72
+			r.drawMath(*w.span.math, x, y+lh/2+0.3*w.span.size*mmPerPt-w.span.rise, w.span.color)
+			x += w.width
+			continue
+		}
+		r.setFont(w.span)
+		r.pdf.SetXY(x, y-w.span.rise)
+		r.pdf.CellFormat(w.width, lh, w.text, "", 0, "L", false, w.span.linkID, w.span.link)
+		x += w.width
+	}
+}
+
+// paragraph lays out and draws spans as a block of wrapped text
+func (r *pdfRenderer) paragraph(spans []pdfSpan, x, width float64, align string) {
+	if len(spans) == 0 {
+		return
+	}
+	r.draw(r.layout(spans, width), x, width, lineHeight(spans[0].size), align)
+}
+
+// ensureSpace starts a new page if the given height does not fit on the current page
+// above its footnotes
+func (r *pdfRenderer) ensureSpace(h float64) {
+	_, pageH := r.pdf.GetPageSize()
+	if r.pdf.GetY()+h > pageH-pdfMargin-r.notesH {
+		r.newPage()
+	}
+}
+
+// newPage draws the footnotes of the current page and starts a new page
+func (r *pdfRenderer) newPage() {
+	r.footnotes()
+	r.pdf.AddPage()
+}
+
+// noteLines lays out the text of a footnote, preceded by its number
+func (r *pdfRenderer) noteLines(note *Footnote) []pdfLine {
+	base := pdfSpan{family: "Arial", size: pdfNoteSize}
+	number := base
+	number.text = strconv.Itoa(note.Number) + "."
+	text := base
+	text.text = note.Content.Value
+	spans := []pdfSpan{text}
+	if note.Content.Typ != NodeFootnote {
+		spans = r.spans(note.Content, base)
+	}
+	if len(spans) > 0 {
+		spans[0].space = true
+	}
+	pageW, _ := r.pdf.GetPageSize()
+	return r.layout(append([]pdfSpan{number}, spans...), pageW-2*pdfMargin)
+}
+
+// footnotesHeight returns the height the given footnotes add to the bottom of the current page
+func (r *pdfRenderer) footnotesHeight(notes []*Footnote) float64 {
+	var h float64
+	if len(notes) > 0 && len(r.pageNotes) == 0 {
+		h += pdfNoteRule
+	}
+	for _, note := range notes {
+		h += float64(len(r.noteLines(note))) * lineHeight(pdfNoteSize)
+	}
+	return h
+}
+
+// placeFootnotes reserves space at the bottom of the current page for footnotes
+func (r *pdfRenderer) placeFootnotes(notes []*Footnote) {
+	r.notesH += r.footnotesHeight(notes)
+	for _, note := range notes {
+		r.placed[note.ID] = true
+		r.pageNotes = append(r.pageNotes, note)
+	}
+}
+
+// footnotes draws the footnotes placed on the current page at its bottom, below a short rule
+func (r *pdfRenderer) footnotes() {
+	if len(r.pageNotes) == 0 {
+		return
+	}
+	pageW, pageH := r.pdf.GetPageSize()
+	lh := lineHeight(pdfNoteSize)
+	y := pageH - pdfMargin - r.notesH
+	r.pdf.SetDrawColor(0, 0, 0)
+	r.pdf.SetLineWidth(0.2)
+	r.pdf.Line(pdfMargin, y+pdfNoteRule/2, pdfMargin+(pageW-2*pdfMargin)/4, y+pdfNoteRule/2)
+	y += pdfNoteRule
+	for _, note := range r.pageNotes {
+		r.pdf.SetLink(r.link(note.ID), y, -1)
+		for _, line := range r.noteLines(note) {
+			r.drawLine(line, pdfMargin, y, pageW-2*pdfMargin, lh, "L")
+			y += lh
+		}
+	}
+	r.pageNotes, r.notesH = nil, 0
+}
+
+// space adds vertical space, unless at the top of a page
+func (r *pdfRenderer) space(h float64) {
+	if r.pdf.GetY() > pdfMargin {
+		r.pdf.SetY(r.pdf.GetY() + h)
+	}
+}
+
+// link returns the internal link to an anchor ID, creating it if necessary
+func (r *pdfRenderer) link(id string) int {
+	link, ok := r.links[id]
+	if !ok {
+		link = r.pdf.AddLink()
+		r.links[id] = link
+	}
+	return link
+}
+
+// anchor places an anchor ID at the current position
+func (r *pdfRenderer) anchor(id string) {
+	r.pages[id] = r.pdf.PageNo()
+	r.pdf.SetLink(r.link(id), r.pdf.GetY(), -1)
+}
+
+// toc renders the table of contents on a page of its own, linking each entry to its heading
+func (r *pdfRenderer) toc() {
+	r.hasToC = true
+	entries := r.doc.ToC()
+	if len(entries) == 0 {
+		return
+	}
+	if r.pdf.GetY() > pdfMargin {
+		r.newPage()
+	}
+	title := pdfSpan{text: "Contents", family: "Arial", style: "B", size: pdfHeadingSizes["1"]}
+	r.paragraph([]pdfSpan{title}, r.x, r.width, "L")
+	r.space(pdfBlockSpace)
+	r.tocEntries(entries, 0)
+	r.pageBreak = true
+}
+
+// tocEntries renders table of contents entries and their children, indented from the margin
+func (r *pdfRenderer) tocEntries(entries []*ToCEntry, indent float64) {
+	const numW = 12.0 // the width of the page number column
+	lh := lineHeight(pdfFontSize)
+	for _, entry := range entries {
+		var page string
+		if p, ok := r.tocPages[entry.ID]; ok {
+			page = strconv.Itoa(p)
+		}
+		style := ""
+		if entry.Level == 1 {
+			style = "B"
+		}
+		link := r.link(entry.ID)
+
+		r.ensureSpace(lh)
+		y := r.pdf.GetY()
+		r.setFont(&pdfSpan{family: "Arial", style: style, size: pdfFontSize})
+		r.pdf.SetXY(r.x+indent, y)
+		r.pdf.CellFormat(r.width-indent-numW, lh, r.tr(entry.Text), "", 0, "L", false, link, "")
+		r.pdf.CellFormat(numW, lh, page, "", 0, "R", false, link, "")
+		r.pdf.SetXY(r.x, y+lh)
+		r.tocEntries(entry.Children, indent+pdfIndent)
+	}
+}
+
+// codeBlock renders the verbatim content of a code block in a monospace font on a shaded background
+// lines wider than the page are broken at the last character that fits
+func (r *pdfRenderer) codeBlock(n *Node) {
+	lh := lineHeight(pdfCodeSize)
+	r.setFont(&pdfSpan{family: "Courier", size: pdfCodeSize})
+	charW := r.pdf.GetStringWidth(" ")
+	perLine := int((r.width - 2*pdfCellPad) / charW)
+	if perLine < 1 {
+		perLine = 1
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(n.Text(), "\t", "    "), "\n") {
+		chars := []rune(strings.TrimRight(line, "\r"))
+		for len(chars) > perLine {
+			lines = append(lines, string(chars[:perLine]))
+			chars = chars[perLine:]
+		}
+		lines = append(lines, string(chars))
+	}
+
+	r.pdf.SetFillColor(240, 240, 240)
+	for i, line := range lines {
+		// pad the first and last lines to leave space around the content
+		h, textY := lh, 0.0
+		if i == 0 {
+			h += pdfCellPad
+			textY = pdfCellPad
+		}
+		if i == len(lines)-1 {
+			h += pdfCellPad
+		}
+		r.ensureSpace(h)
+		y := r.pdf.GetY()
+		r.pdf.Rect(r.x, y, r.width, h, "F")
+		r.pdf.SetXY(r.x+pdfCellPad, y+textY)
+		r.pdf.CellFormat(r.width-2*pdfCellPad, lh, r.tr(line), "", 0, "L", false, 0, "")
+		r.pdf.SetXY(r.x, y+h)
+	}
+}
+
+// list renders the items of a list and the lists nested within them, indented from x
+// tasks are marked by a checkbox instead of a bullet or number
+func (r *pdfRenderer) list(n *Node, base pdfSpan, x float64) {
+	lh := lineHeight(base.size)
+	x += pdfIndent
+	width := r.width - (x - r.x)
+	for i, item := range n.Children {
+		marker := r.tr("•")
+		if listNumbered(n) {
+			marker = strconv.Itoa(i+listStart(n)) + "."
+		}
+		lines := r.layout(r.spans(item, base), width)
+
+		r.ensureSpace(lh)
+		y := r.pdf.GetY()
+		r.setFont(&base)
+		if item.Task {
+			r.checkbox(x-1.5-pdfCheckSize, y+(lh-pdfCheckSize)/2, item.Checked)
+		} else {
+			r.pdf.SetXY(x-pdfIndent, y)
+			r.pdf.CellFormat(pdfIndent-1.5, lh, marker, "", 0, "R", false, 0, "")
+		}
+		r.pdf.SetXY(x, y)
+		if len(lines) == 0 {
+			r.pdf.SetY(y + lh)
+		}
+		r.draw(lines, x, width, lh, "L")
+		for _, child := range item.Children {
+			if child.Typ == NodeList {
+				r.list(child, base, x)
+			}
+		}
+	}
+}
+
+// image registers the image with the given source, returning nil if it cannot be loaded
+func (r *pdfRenderer) image(src string) *gofpdf.ImageInfoType {
+	if info, ok := r.images[src]; ok || r.pdf.Err() {
+		return info
+	}
+	r.images[src] = nil
+	if r.resolve == nil {
+		return nil
+	}
+	rc, err := r.resolve(src)
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(rc, maxImageSize+1))
+	rc.Close()
+	tp := imageType(data)
+	if err != nil || tp == "" || len(data) > maxImageSize {
+		return nil
+	}
+	info := r.pdf.RegisterImageOptionsReader(src, gofpdf.ImageOptions{ImageType: tp, ReadDpi: true}, bytes.NewReader(data))
+	if r.pdf.Err() {
+		// a broken image must not prevent the rest of the document from rendering
+		r.pdf.ClearError()
+		return nil
+	}
+	r.images[src] = info
+	return info
+}
+
+// figure renders the image of a figure centred on the page, followed by its caption
+// the width attribute sets the width of the image in mm or as a percentage of the page content,
+// images that cannot be loaded are replaced by a box containing their source
+func (r *pdfRenderer) figure(n *Node) {
+	caption := pdfSpan{family: "Arial", style: "I", size: pdfTableSize}
+	lines := r.layout(r.spans(n, caption), r.width)
+	captionH := float64(len(lines)) * lineHeight(caption.size)
+
+	w, h := r.width, pdfNoImageH
+	width, hasWidth := n.attr("width")
+	if v := pdfLength(width, r.width); v > 0 && v < r.width {
+		w = v
+	}
+	info := r.image(n.URL)
+	if info != nil {
+		iw, ih := info.Extent()
+		if !hasWidth && iw < w {
+			w = iw
+		}
+		h = w * ih / iw
+		// scale down images too high to fit on a page
+		_, pageH := r.pdf.GetPageSize()
+		if maxH := pageH - 2*pdfMargin - captionH; h > maxH {
+			w, h = w*maxH/h, maxH
+		}
+	}
+
+	r.ensureSpace(h + captionH)
+	x := r.x + (r.width-w)/2
+	y := r.pdf.GetY()
+	if info != nil {
+		r.pdf.ImageOptions(n.URL, x, y, w, h, false, gofpdf.ImageOptions{}, 0, "")
+	} else {
+		r.setFont(&caption)
+		r.pdf.SetDrawColor(150, 150, 150)
+		r.pdf.Rect(x, y, w, h, "D")
+		r.pdf.SetDrawColor(0, 0, 0)
+		r.pdf.SetXY(x, y)
+		r.pdf.CellFormat(w, h, r.tr(n.URL), "", 0, "C", false, 0, "")
+	}
+	r.pdf.SetXY(r.x, y+h)
+	r.draw(lines, r.x, r.width, lineHeight(caption.size), "C")
+}
+
+// pdfLength returns a length in mm given in mm or as a percentage of full, or 0 if it is not a length
+func pdfLength(s string, full float64) float64 {
+	pct := strings.HasSuffix(s, "%")
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSuffix(s, "%"), "mm"), 64)
+	if err != nil || v <= 0 {
+		return 0
+	}
+	if pct {
+		return full * v / 100
+	}
+	return v
+}
+
+// container renders the block elements of a container block within a shaded box with an accent bar,
+// admonitions are headed by an icon and their label
+// boxes too high to fit on a page are rendered without shading
+func (r *pdfRenderer) container(n *Node) {
+	style := pdfContainerStyles[n.Typ]
+	pad := 2 * pdfCellPad
+
+	// find the height of the box by rendering its content on a scratch document, the boxes of nested
+	// container blocks measured along the way are kept so each box is only measured once
+	box, ok := r.boxes[n]
+	if !ok {
+		scratch := newPDFRenderer(r.doc, PDFOptions{ImageResolver: r.resolve}, r.tocPages)
+		scratch.x, scratch.width = r.x, r.width
+		scratch.boxes = r.boxes
+		for id := range r.placed {
+			scratch.placed[id] = true
+		}
+		scratch.containerBody(n, style, pdfMargin)
+		box.h = scratch.pdf.GetY() - pdfMargin - pdfBlockSpace + pad
+		box.notesH = scratch.notesH
+		_, pageH := r.pdf.GetPageSize()
+		box.fits = scratch.pdf.PageNo() == 1 && box.h <= pageH-2*pdfMargin
+		r.boxes[n] = box
+	}
+	h, fits := box.h, box.fits
+
+	y := r.pdf.GetY()
+	if fits {
+		// leave space for the footnotes referenced within the box
+		r.ensureSpace(h + box.notesH)
+		y = r.pdf.GetY()
+		r.pdf.SetFillColor(style.fill[0], style.fill[1], style.fill[2])
+		r.pdf.Rect(r.x, y, r.width, h, "F")
+		r.pdf.SetFillColor(style.accent[0], style.accent[1], style.accent[2])
+		r.pdf.Rect(r.x, y, pdfAccentW, h, "F")
+	}
+	r.containerBody(n, style, y)
+	if fits {
+		r.pdf.SetXY(r.x, y+h)
+	}
+}
+
+// containerBody renders the content of a container block whose box begins at y
+func (r *pdfRenderer) containerBody(n *Node, style pdfContainerStyle, y float64) {
+	pad := 2 * pdfCellPad
+	x, width := r.x, r.width
+	if r.width-pdfAccentW-2*pad >= pdfMinWidth {
+		r.x += pdfAccentW + pad
+		r.width -= pdfAccentW + 2*pad
+	}
+	r.pdf.SetY(y + pad)
+
+	if style.label != "" {
+		lh := lineHeight(pdfFontSize)
+		r.ensureSpace(lh)
+		ly := r.pdf.GetY()
+		r.pdf.SetFillColor(style.accent[0], style.accent[1], style.accent[2])
+		r.pdf.Circle(r.x+pdfIconSize/2, ly+lh/2, pdfIconSize/2, "F")
+		icon := pdfSpan{family: "Arial", style: "B", size: 8, color: [3]int{255, 255, 255}}
+		r.setFont(&icon)
+		r.pdf.SetXY(r.x, ly+(lh-pdfIconSize)/2)
+		r.pdf.CellFormat(pdfIconSize, pdfIconSize, style.icon, "", 0, "C", false, 0, "")
+		label := pdfSpan{text: style.label, family: "Arial", style: "B", size: pdfFontSize, color: style.accent}
+		r.pdf.SetY(ly)
+		r.paragraph([]pdfSpan{label}, r.x+pdfIconSize+pdfCellPad, r.width-pdfIconSize-pdfCellPad, "L")
+		r.space(pdfCellPad)
+	}
+	r.blocks(n)
+	r.x, r.width = x, width
+}
+
+// checkbox draws the box of a task at x, y, ticked if it is checked
+func (r *pdfRenderer) checkbox(x, y float64, checked bool) {
+	r.pdf.SetLineWidth(0.2)
+	r.pdf.Rect(x, y, pdfCheckSize, pdfCheckSize, "D")
+	if checked {
+		r.pdf.SetLineWidth(0.4)
+		r.pdf.Line(x+0.6, y+pdfCheckSize*0.55, x+pdfCheckSize*0.4, y+pdfCheckSize-0.6)
+		r.pdf.Line(x+pdfCheckSize*0.4, y+pdfCheckSize-0.6, x+pdfCheckSize-0.5, y+0.5)
+		r.pdf.SetLineWidth(0.2)
+	}
+}
+
+// table renders a table with borders, the header and footer rows are bold and shaded
+// each row is kept on a single page with its footnotes, as are the rows spanned by its cells where possible
+func (r *pdfRenderer) table(n *Node) {
+	rows, cols := tableGrid(n)
+	if cols == 0 {
+		return
+	}
+	colW := r.width / float64(cols)
+	lh := lineHeight(pdfTableSize)
+	hasHeader, hasFooter := n.hasAttr("h"), n.hasAttr("f")
+	shaded := func(row int) bool {
+		return row == 0 && hasHeader || row == len(rows)-1 && hasFooter
+	}
+
+	// lay out each cell to find the height of each row, the last row spanned by a cell
+	// grows to fit the cell if the rows it spans are not high enough
+	lines := map[*Node][]pdfLine{}
+	rowH := make([]float64, len(rows))
+	for i := range rowH {
+		rowH[i] = lh + 2*pdfCellPad
+	}
+	for _, spanning := range []bool{false, true} {
+		for i, row := range rows {
+			for _, data := range row {
+				if (span(data.RowSpan) > 1) != spanning {
+					continue
+				}
+				base := pdfSpan{family: "Arial", size: pdfTableSize}
+				if shaded(i) {
+					base.style = "B"
+				}
+				w := float64(span(data.ColSpan))*colW - 2*pdfCellPad
+				lines[data.Node] = r.layout(r.spans(data.Node, base), w)
+				h := float64(len(lines[data.Node]))*lh + 2*pdfCellPad
+				last := i + span(data.RowSpan) - 1
+				for j := i; j < last; j++ {
+					h -= rowH[j]
+				}
+				if h > rowH[last] {
+					rowH[last] = h
+				}
+			}
+		}
+	}
+
+	for i, row := range rows {
+		// keep the rows spanned by cells of this row together
+		h := rowH[i]
+		for _, data := range row {
+			var spanH float64
+			for j := i; j < i+span(data.RowSpan); j++ {
+				spanH += rowH[j]
+			}
+			if spanH > h {
+				h = spanH
+			}
+		}
+		// the footnotes referenced by the row are placed on the same page as the row
+		var rowLines []pdfLine
+		for _, data := range row {
+			rowLines = append(rowLines, lines[data.Node]...)
+		}
+		notes := r.lineNotes(rowLines)
+		r.ensureSpace(h + r.footnotesHeight(notes))
+		r.placeFootnotes(notes)
+
+		y := r.pdf.GetY()
+		r.pdf.SetDrawColor(0, 0, 0)
+		r.pdf.SetFillColor(230, 230, 230)
+		for _, data := range row {
+			x := r.x + float64(data.col)*colW
+			w := float64(span(data.ColSpan)) * colW
+			var cellH float64
+			for j := i; j < i+span(data.RowSpan); j++ {
+				cellH += rowH[j]
+			}
+			if shaded(i) {
+				r.pdf.Rect(x, y, w, cellH, "DF")
+			} else {
+				r.pdf.Rect(x, y, w, cellH, "D")
+			}
+			align := "L"
+			switch columnAlign(n, data.col) {
+			case "center":
+				align = "C"
+			case "right":
+				align = "R"
+			}
+			for k, line := range lines[data.Node] {
+				r.drawLine(line, x+pdfCellPad, y+pdfCellPad+float64(k)*lh, w-2*pdfCellPad, lh, align)
+			}
+		}
+		r.pdf.SetXY(r.x, y+rowH[i])
+	}
+}
@@ -0,0 +1,150 @@
+package opalparser
+
+import "fmt"
+
+// list of cell markers, the content of cells merged into a neighbouring cell
+const (
+	cellMergeLeft = "<" // extends the cell to the left by a column
+	cellMergeUp   = "^" // extends the cell above by a row
+)
+
+// resolveTableSpans merges cells containing only a cell marker into the cell to their left or above,
+// and warns about rows with a different number of cells to the first row
+// a marker which would extend a cell over another cell is kept as the text of its own cell
+func (p *Parser) resolveTableSpans(table *Node) {
+	if len(table.Children) == 0 {
+		return
+	}
+	extents := map[*Node]*cellExtent{}
+	// origins maps each cell as written to the cell covering it once merged
+	origins := make([][]*Node, len(table.Children))
+	want := len(table.Children[0].Children)
+	for i, row := range table.Children {
+		if got := len(row.Children); got != want {
+			p.addNodeDiagnostic(row, SeverityWarning, errCellCount, fmt.Sprintf(" (expected %d, found %d)", want, got))
+		}
+		origins[i] = make([]*Node, len(row.Children))
+		cells := row.Children[:0]
+		for j, data := range row.Children {
+			var origin *Node
+			switch data.Text() {
+			case cellMergeLeft:
+				if j > 0 {
+					origin = origins[i][j-1]
+				}
+			case cellMergeUp:
+				if i > 0 && j < len(origins[i-1]) {
+					origin = origins[i-1][j]
+				}
+			}
+			if origin != nil && !extents[origin].canExtend(origins, row, origin, i, j) {
+				p.addNodeDiagnostic(data, SeverityWarning, errCellCount, " (merged cell overlaps another cell)")
+				origin = nil
+			}
+			if origin == nil {
+				origins[i][j] = data
+				extents[data] = &cellExtent{i, j, i, j}
+				cells = append(cells, data)
+				continue
+			}
+			origins[i][j] = origin
+			e := extents[origin]
+			if i > e.lastRow {
+				e.lastRow = i
+				origin.RowSpan = e.lastRow - e.row + 1
+			}
+			if j > e.lastCol {
+				e.lastCol = j
+				origin.ColSpan = e.lastCol - e.col + 1
+			}
+		}
+		row.Children = cells
+	}
+}
+
+// cellExtent is the first and last row and column covered by a cell once merged
+type cellExtent struct{ row, col, lastRow, lastCol int }
+
+// canExtend reports whether the cell origin, covering the extent e, can be extended over the cell at
+// row i and column j without covering any cell not merged into it
+// cells of row i after column j are yet to be merged, so only need to be cell markers
+func (e *cellExtent) canExtend(origins [][]*Node, row *Node, origin *Node, i, j int) bool {
+	if i > e.lastRow {
+		for c := e.col; c <= e.lastCol && c < len(row.Children); c++ {
+			switch {
+			case c < j && origins[i][c] != origin:
+				return false
+			case c > j && row.Children[c].Text() != cellMergeLeft && row.Children[c].Text() != cellMergeUp:
+				return false
+			}
+		}
+	}
+	if j > e.lastCol {
+		for r := e.row; r < i; r++ {
+			if j < len(origins[r]) && origins[r][j] != origin {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// span returns the number of rows or columns spanned by a cell, given its RowSpan or ColSpan
+func span(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// tableCell is a cell placed within the grid of the columns of its table
+type tableCell struct {
+	*Node
+	row, col int
+}
+
+// tableGrid places the cells of a table within the grid of its columns, skipping columns occupied
+// by cells spanning down from rows above
+// it returns the cells of each row and the number of columns
+func tableGrid(table *Node) ([][]tableCell, int) {
+	rows := make([][]tableCell, len(table.Children))
+	occupied := map[[2]int]bool{}
+	var cols int
+	for i, row := range table.Children {
+		col := 0
+		for _, data := range row.Children {
+			for occupied[[2]int{i, col}] {
+				col++
+			}
+			rows[i] = append(rows[i], tableCell{data, i, col})
+			for r := i; r < i+span(data.RowSpan); r++ {
+				for c := col; c < col+span(data.ColSpan); c++ {
+					occupied[[2]int{r, c}] = true
+				}
+			}
+			col += span(data.ColSpan)
+			if col > cols {
+				cols = col
+			}
+		}
+	}
+	return rows, cols
+}
+
+// columnAlign returns the alignment of a column of a table, given by the letters l, c and r of its
+// align attribute in column order, or an empty string if none is given
+func columnAlign(table *Node, col int) string {
+	align, _ := table.attr("align")
+	if col >= len(align) {
+		return ""
+	}
+	switch align[col] {
+	case 'l', 'L':
+		return "left"
+	case 'c', 'C':
+		return "center"
+	case 'r', 'R':
+		return "right"
+	}
+	return ""
+}
@@ -0,0 +1,126 @@
+package opalparser
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ToCEntry is an entry in the table of contents of a document
+type ToCEntry struct {
+	Level    int         `json:"level"`              // the heading level, from 1 to 6
+	Text     string      `json:"text"`               // the plain text of the heading
+	ID       string      `json:"id"`                 // the anchor ID of the heading
+	Children []*ToCEntry `json:"children,omitempty"` // the entries of the subheadings
+}
+
+// ToC returns the table of contents of the document
+// entries are nested by heading level, in the order the headings appear
+func (d *Document) ToC() []*ToCEntry {
+	var toc, stack []*ToCEntry
+	walkNodes(d.Root, func(n *Node) {
+		if n.Typ != NodeHeading {
+			return
+		}
+		level, _ := strconv.Atoi(n.Level)
+		entry := &ToCEntry{Level: level, Text: n.Text(), ID: n.ID}
+		for len(stack) > 0 && stack[len(stack)-1].Level >= level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			toc = append(toc, entry)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, entry)
+		}
+		stack = append(stack, entry)
+	})
+	return toc
+}
+
+// walkNodes calls fn for n and each of its descendants, depth first
+func walkNodes(n *Node, fn func(*Node)) {
+	fn(n)
+	for _, child := range n.Children {
+		walkNodes(child, fn)
+	}
+}
+
+// resolveAnchors gives every heading a unique anchor ID and links references to them
+func (p *Parser) resolveAnchors(root *Node) {
+	ids := p.assignHeadingIDs(root)
+	walkNodes(root, func(n *Node) {
+		if n.Typ != NodeRef {
+			return
+		}
+		// references can use the anchor ID or the heading text
+		heading, ok := ids[n.Value]
+		if !ok {
+			heading, ok = ids[slugify(n.Value)]
+		}
+		if !ok {
+			p.addNodeDiagnostic(n, SeverityWarning, errDanglingRef, " '"+n.Value+"'")
+			n.DisplayText = n.Value
+			return
+		}
+		n.DisplayText = heading.Text()
+		n.URL = "#" + heading.ID
+	})
+}
+
+// assignHeadingIDs gives every heading a unique anchor ID and returns the headings by ID
+// IDs set with the id attribute are kept, other IDs are derived from the heading text
+// with repeated IDs suffixed with -1, -2, etc.
+func (p *Parser) assignHeadingIDs(root *Node) map[string]*Node {
+	ids := map[string]*Node{}
+	walkNodes(root, func(n *Node) {
+		if n.Typ != NodeHeading {
+			return
+		}
+		id, ok := n.attr("id")
+		if !ok {
+			return
+		}
+		if _, ok := ids[id]; ok {
+			p.addNodeDiagnostic(n, SeverityWarning, errDuplicateID, " '"+id+"'")
+			return
+		}
+		n.ID = id
+		ids[id] = n
+	})
+	walkNodes(root, func(n *Node) {
+		if n.Typ != NodeHeading || n.ID != "" {
+			return
+		}
+		base := slugify(n.Text())
+		id := base
+		for i := 1; ids[id] != nil; i++ {
+			id = base + "-" + strconv.Itoa(i)
+		}
+		n.ID = id
+		ids[id] = n
+	})
+	return ids
+}
+
+// slugify converts text into an anchor ID containing only lowercase letters, digits and hyphens
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, c := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsNumber(c):
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(c)
+		case unicode.IsSpace(c) || c == '-' || c == '_':
+			hyphen = true
+		}
+	}
+	if b.Len() == 0 {
+		return "section"
+	}
+	return b.String()
+}